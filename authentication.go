@@ -40,7 +40,7 @@ func (t *basicTicketAuthenticator) Authenticate(challenge map[string]interface{}
 // NewBasicTicketAuthenticator creates a basic ticket authenticator from a static set of valid tickets.
 //
 // This method of ticket-based authentication is insecure, but useful for bootstrapping.
-// Do not use this in production.
+// Do not use this in production, use NewJWTAuthenticator instead.
 func NewBasicTicketAuthenticator(tickets ...string) CRAuthenticator {
 	authenticator := &basicTicketAuthenticator{tickets: make(map[string]bool)}
 	for _, ticket := range tickets {
@@ -48,3 +48,28 @@ func NewBasicTicketAuthenticator(tickets ...string) CRAuthenticator {
 	}
 	return authenticator
 }
+
+type anonymousAuthenticator struct {
+	authrole string
+}
+
+// NewAnonymousAuthenticator creates an authenticator, for the "anonymous"
+// authmethod, that welcomes every client with a random authid and the given
+// authrole, which defaults to "anonymous".
+//
+// It can also be used as a realm's DefaultAuthenticator, to let in clients
+// that don't authenticate.
+func NewAnonymousAuthenticator(authrole string) Authenticator {
+	if authrole == "" {
+		authrole = "anonymous"
+	}
+	return &anonymousAuthenticator{authrole: authrole}
+}
+
+func (a *anonymousAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	return map[string]interface{}{
+		"authid":       fmt.Sprintf("anonymous-%d", NewID()),
+		"authrole":     a.authrole,
+		"authprovider": "static",
+	}, nil
+}
@@ -9,6 +9,12 @@ type Authorizer interface {
 	Authorize(session *Session, msg Message) (bool, error)
 }
 
+// sessionRemover is implemented by authorizers that keep state for each
+// session, which the realm calls when a session leaves.
+type sessionRemover interface {
+	RemoveSession(session *Session)
+}
+
 // DefaultAuthorizer always returns authorized.
 type defaultAuthorizer struct {
 }
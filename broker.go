@@ -1,6 +1,9 @@
 package turnpike
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
 // Broker is the interface implemented by an object that handles routing EVENTS
 // from Publishers to Subscribers.
@@ -15,21 +18,45 @@ type Broker interface {
 	RemoveSession(*Session)
 }
 
+type subscription struct {
+	match       string
+	created     time.Time
+	subscribers map[*Session]struct{}
+}
+
 // A super simple broker that matches URIs to Subscribers.
 type defaultBroker struct {
-	routes        map[URI]map[ID]*Session
+	// map topics to subscription IDs, one map for each match policy
+	routes         map[URI]ID
+	prefixRoutes   map[URI]ID
+	wildcardRoutes map[URI]ID
+	// map subscription IDs to topics
 	subscriptions map[ID]URI
-	sessions      map[*Session]map[ID]struct{}
-	lock          sync.RWMutex
+	// map subscription IDs to their match policy and subscribers
+	subscribers map[ID]*subscription
+	// keep track of each subscriber's subscriptions
+	sessions map[*Session]map[ID]struct{}
+	lock     sync.RWMutex
+	// event history and retained event of each topic
+	history    map[URI]*eventHistory
+	retained   map[URI]*storedEvent
+	eventsLock sync.Mutex
+	// publishes subscription meta events, set by the realm
+	publish func(*Publish)
 }
 
 // NewDefaultBroker initializes and returns a simple broker that matches URIs to
 // Subscribers.
 func NewDefaultBroker() Broker {
 	return &defaultBroker{
-		routes:        make(map[URI]map[ID]*Session),
-		subscriptions: make(map[ID]URI),
-		sessions:      make(map[*Session]map[ID]struct{}),
+		routes:         make(map[URI]ID),
+		prefixRoutes:   make(map[URI]ID),
+		wildcardRoutes: make(map[URI]ID),
+		subscriptions:  make(map[ID]URI),
+		subscribers:    make(map[ID]*subscription),
+		sessions:       make(map[*Session]map[ID]struct{}),
+		history:        make(map[URI]*eventHistory),
+		retained:       make(map[URI]*storedEvent),
 	}
 }
 
@@ -37,51 +64,221 @@ func NewDefaultBroker() Broker {
 //
 // If msg.Options["acknowledge"] == true, the publisher receives a Published event
 // after the message has been sent to all subscribers.
+//
+// Subscribers with a prefix or wildcard subscription receive the topic the
+// event was published to in Details["topic"].
+//
+// msg.Options["exclude"], ["exclude_authid"] and ["exclude_authrole"] list
+// session IDs, authids and authroles that must not receive the event, and
+// msg.Options["eligible"], ["eligible_authid"] and ["eligible_authrole"] limit
+// the event to the listed sessions, authids and authroles.
+//
+// If msg.Options["disclose_me"] == true, subscribers receive the publisher's
+// session ID, authid and authrole in Details["publisher"],
+// ["publisher_authid"] and ["publisher_authrole"].
+//
+// If msg.Options["retain"] == true, the event is kept as the topic's retained
+// event, and sent to later subscribers that ask for it. Only topics with an
+// event history keep a retained event, until it is older than the history's
+// maximum age.
 func (br *defaultBroker) Publish(pub *Session, msg *Publish) {
 	pubID := NewID()
+	details := make(map[string]interface{})
+	if disclose, _ := msg.Options["disclose_me"].(bool); disclose {
+		details["publisher"] = pub.Id
+		if pub.AuthId != "" {
+			details["publisher_authid"] = pub.AuthId
+		}
+		if pub.AuthRole != "" {
+			details["publisher_authrole"] = pub.AuthRole
+		}
+	}
 	evtTemplate := Event{
 		Publication: pubID,
 		Arguments:   msg.Arguments,
 		ArgumentsKw: msg.ArgumentsKw,
-		Details:     make(map[string]interface{}),
+		Details:     details,
+	}
+	patternDetails := map[string]interface{}{"topic": msg.Topic}
+	for k, v := range details {
+		patternDetails[k] = v
 	}
 
 	excludePublisher := true
 	if exclude, ok := msg.Options["exclude_me"].(bool); ok {
 		excludePublisher = exclude
 	}
+	eligible := eligibleFilter(msg.Options)
 
 	br.lock.RLock()
-	for id, sub := range br.routes[msg.Topic] {
-		// don't send event to publisher
-		if sub == pub && excludePublisher {
-			continue
-		}
+	for _, id := range br.match(msg.Topic) {
+		s := br.subscribers[id]
+		for sub := range s.subscribers {
+			// don't send event to publisher
+			if sub == pub && excludePublisher {
+				continue
+			}
+			if !eligible(sub) {
+				continue
+			}
 
-		// shallow-copy the template
-		event := evtTemplate
-		event.Subscription = id
-		sub.Send(&event)
+			// shallow-copy the template
+			event := evtTemplate
+			event.Subscription = id
+			if s.match != MatchExact {
+				event.Details = patternDetails
+			}
+			sub.Send(&event)
+		}
 	}
 	br.lock.RUnlock()
 
+	br.store(msg, pubID, details)
+
 	// only send published message if acknowledge is present and set to true
 	if doPub, _ := msg.Options["acknowledge"].(bool); doPub {
 		pub.Send(&Published{Request: msg.Request, Publication: pubID})
 	}
 }
 
+// eligibleFilter returns a function that reports whether a subscriber may
+// receive an event, according to the black- and whitelisting options of a
+// PUBLISH.
+func eligibleFilter(options map[string]interface{}) func(*Session) bool {
+	exclude, eligible := idSet(options["exclude"]), idSet(options["eligible"])
+	excludeAuthId, eligibleAuthId := stringSet(options["exclude_authid"]), stringSet(options["eligible_authid"])
+	excludeAuthRole, eligibleAuthRole := stringSet(options["exclude_authrole"]), stringSet(options["eligible_authrole"])
+
+	return func(sub *Session) bool {
+		switch {
+		case exclude[sub.Id], excludeAuthId[sub.AuthId], excludeAuthRole[sub.AuthRole]:
+			return false
+		case eligible != nil && !eligible[sub.Id]:
+			return false
+		case eligibleAuthId != nil && !eligibleAuthId[sub.AuthId]:
+			return false
+		case eligibleAuthRole != nil && !eligibleAuthRole[sub.AuthRole]:
+			return false
+		}
+		return true
+	}
+}
+
+// idSet converts a list of session IDs from a PUBLISH option into a set, or
+// returns nil if the option is absent.
+func idSet(v interface{}) map[ID]bool {
+	var list []interface{}
+	switch v := v.(type) {
+	case []interface{}:
+		list = v
+	case []ID:
+		for _, id := range v {
+			list = append(list, id)
+		}
+	default:
+		return nil
+	}
+	set := make(map[ID]bool)
+	for _, id := range list {
+		if id, ok := toInt64(id); ok {
+			set[ID(id)] = true
+		}
+	}
+	return set
+}
+
+// stringSet converts a list of strings from a PUBLISH option into a set, or
+// returns nil if the option is absent.
+func stringSet(v interface{}) map[string]bool {
+	var list []interface{}
+	switch v := v.(type) {
+	case []interface{}:
+		list = v
+	case []string:
+		for _, s := range v {
+			list = append(list, s)
+		}
+	default:
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, s := range list {
+		if s, ok := s.(string); ok {
+			set[s] = true
+		}
+	}
+	return set
+}
+
+// match returns the IDs of all subscriptions that match the topic.
+//
+// The caller must hold the lock.
+func (br *defaultBroker) match(topic URI) []ID {
+	var ids []ID
+	if id, ok := br.routes[topic]; ok {
+		ids = append(ids, id)
+	}
+	for prefix, id := range br.prefixRoutes {
+		if matchURI(MatchPrefix, prefix, topic) {
+			ids = append(ids, id)
+		}
+	}
+	for pattern, id := range br.wildcardRoutes {
+		if matchURI(MatchWildcard, pattern, topic) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// routesFor returns the routes for the given match policy.
+func (br *defaultBroker) routesFor(match string) map[URI]ID {
+	switch match {
+	case MatchPrefix:
+		return br.prefixRoutes
+	case MatchWildcard:
+		return br.wildcardRoutes
+	default:
+		return br.routes
+	}
+}
+
 // Subscribe subscribes the client to the given topic.
+//
+// msg.Options["match"] may be "exact" (the default), "prefix" or "wildcard".
+// All subscribers to the same topic with the same match policy share a
+// subscription ID.
+//
+// If msg.Options["get_retained"] == true, the subscriber receives the retained
+// events of the matching topics, with Details["retained"] == true.
 func (br *defaultBroker) Subscribe(sub *Session, msg *Subscribe) {
-	id := NewID()
+	match, ok := matchPolicy(msg.Options)
+	if !ok {
+		log.Printf("Error subscribing: invalid match policy %v", msg.Options["match"])
+		sub.Send(&Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: make(map[string]interface{}),
+			Error:   ErrInvalidArgument,
+		})
+		return
+	}
 
 	br.lock.Lock()
-	r, ok := br.routes[msg.Topic]
-	if !ok {
-		r = make(map[ID]*Session)
-		br.routes[msg.Topic] = r
+	routes := br.routesFor(match)
+	id, exists := routes[msg.Topic]
+	if !exists {
+		id = NewID()
+		routes[msg.Topic] = id
+		br.subscriptions[id] = msg.Topic
+		br.subscribers[id] = &subscription{
+			match:       match,
+			created:     time.Now(),
+			subscribers: make(map[*Session]struct{}),
+		}
 	}
-	r[id] = sub
+	br.subscribers[id].subscribers[sub] = struct{}{}
+	details := br.details(id)
 
 	s, ok := br.sessions[sub]
 	if !ok {
@@ -89,17 +286,26 @@ func (br *defaultBroker) Subscribe(sub *Session, msg *Subscribe) {
 		br.sessions[sub] = s
 	}
 	s[id] = struct{}{}
-
-	br.subscriptions[id] = msg.Topic
 	br.lock.Unlock()
 
 	sub.Send(&Subscribed{Request: msg.Request, Subscription: id})
+	if getRetained, _ := msg.Options["get_retained"].(bool); getRetained {
+		br.sendRetained(sub, id, match, msg.Topic)
+	}
+
+	// subscriptions to meta events don't generate meta events themselves
+	if isMetaURI(msg.Topic) {
+		return
+	}
+	if !exists {
+		br.publishMeta("wamp.subscription.on_create", sub.Id, details)
+	}
+	br.publishMeta("wamp.subscription.on_subscribe", sub.Id, id)
 }
 
 func (br *defaultBroker) Unsubscribe(sub *Session, msg *Unsubscribe) {
 	br.lock.Lock()
-	topic, ok := br.subscriptions[msg.Subscription]
-	if !ok {
+	if _, ok := br.sessions[sub][msg.Subscription]; !ok {
 		br.lock.Unlock()
 		err := &Error{
 			Type:    msg.MessageType(),
@@ -110,56 +316,100 @@ func (br *defaultBroker) Unsubscribe(sub *Session, msg *Unsubscribe) {
 		log.Printf("Error unsubscribing: no such subscription %v", msg.Subscription)
 		return
 	}
-	delete(br.subscriptions, msg.Subscription)
-
-	// clean up routes
-	if r, ok := br.routes[topic]; !ok {
-		log.Printf("Error unsubscribing: unable to find routes for %s topic", topic)
-	} else if _, ok := r[msg.Subscription]; !ok {
-		log.Printf("Error unsubscribing: %s route does not exist for %v subscription", topic, msg.Subscription)
-	} else {
-		delete(r, msg.Subscription)
-		if len(r) == 0 {
-			delete(br.routes, topic)
-		}
-	}
+	publish := !isMetaURI(br.subscriptions[msg.Subscription])
+	deleted := br.removeSubscriber(sub, msg.Subscription)
 
 	// clean up sender's subscription
-	if s, ok := br.sessions[sub]; !ok {
-		log.Println("Error unsubscribing: unable to find sender's subscriptions")
-	} else if _, ok := s[msg.Subscription]; !ok {
-		log.Printf("Error unsubscribing: sender does not contain %v subscription", msg.Subscription)
-	} else {
-		delete(s, msg.Subscription)
-		if len(s) == 0 {
-			delete(br.sessions, sub)
-		}
+	delete(br.sessions[sub], msg.Subscription)
+	if len(br.sessions[sub]) == 0 {
+		delete(br.sessions, sub)
 	}
 	br.lock.Unlock()
 
 	sub.Send(&Unsubscribed{Request: msg.Request})
+
+	if !publish {
+		return
+	}
+	br.publishMeta("wamp.subscription.on_unsubscribe", sub.Id, msg.Subscription)
+	if deleted {
+		br.publishMeta("wamp.subscription.on_delete", sub.Id, msg.Subscription)
+	}
 }
 
 func (br *defaultBroker) RemoveSession(sub *Session) {
 	br.lock.Lock()
-	defer br.lock.Unlock()
-
-	for id, _ := range br.sessions[sub] {
-		topic, ok := br.subscriptions[id]
-		if !ok {
-			continue
+	var removed, deleted []ID
+	for id := range br.sessions[sub] {
+		publish := !isMetaURI(br.subscriptions[id])
+		if br.removeSubscriber(sub, id) && publish {
+			deleted = append(deleted, id)
 		}
-		delete(br.subscriptions, id)
-
-		// clean up routes
-		if r, ok := br.routes[topic]; ok {
-			if _, ok := r[id]; ok {
-				delete(r, id)
-				if len(r) == 0 {
-					delete(br.routes, topic)
-				}
-			}
+		if publish {
+			removed = append(removed, id)
 		}
 	}
 	delete(br.sessions, sub)
+	br.lock.Unlock()
+
+	for _, id := range removed {
+		br.publishMeta("wamp.subscription.on_unsubscribe", sub.Id, id)
+	}
+	for _, id := range deleted {
+		br.publishMeta("wamp.subscription.on_delete", sub.Id, id)
+	}
+}
+
+// removeSubscriber removes the session from the subscription, and removes the
+// subscription if it has no subscribers left. It reports whether the
+// subscription was removed.
+//
+// The caller must hold the lock.
+func (br *defaultBroker) removeSubscriber(sub *Session, id ID) bool {
+	s, ok := br.subscribers[id]
+	if !ok {
+		log.Printf("Error unsubscribing: unable to find subscribers for %v subscription", id)
+		return false
+	}
+	delete(s.subscribers, sub)
+	if len(s.subscribers) > 0 {
+		return false
+	}
+
+	// clean up routes
+	topic := br.subscriptions[id]
+	delete(br.routesFor(s.match), topic)
+	delete(br.subscriptions, id)
+	delete(br.subscribers, id)
+	return true
+}
+
+// details returns the details of a subscription, as sent in meta events and
+// returned by wamp.subscription.get.
+//
+// The caller must hold the lock.
+func (br *defaultBroker) details(id ID) map[string]interface{} {
+	s := br.subscribers[id]
+	return map[string]interface{}{
+		"id":      id,
+		"created": s.created.UTC().Format(time.RFC3339Nano),
+		"uri":     br.subscriptions[id],
+		"match":   s.match,
+	}
+}
+
+// publishMeta publishes a subscription meta event, if the broker is attached
+// to a realm.
+//
+// The caller must not hold the lock.
+func (br *defaultBroker) publishMeta(topic URI, args ...interface{}) {
+	if br.publish == nil {
+		return
+	}
+	br.publish(&Publish{
+		Request:   NewID(),
+		Options:   make(map[string]interface{}),
+		Topic:     topic,
+		Arguments: args,
+	})
 }
@@ -2,6 +2,7 @@ package turnpike
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -105,3 +106,281 @@ func TestRemove(t *testing.T) {
 		})
 	})
 }
+
+func TestSharedSubscription(t *testing.T) {
+	Convey("Two sessions subscribing to the same topic", t, func() {
+		broker := NewDefaultBroker().(*defaultBroker)
+		subscriber1, subscriber2 := &TestPeer{}, &TestPeer{}
+		sess1, sess2 := &Session{Peer: subscriber1}, &Session{Peer: subscriber2}
+		testTopic := URI("turnpike.test.topic")
+		broker.Subscribe(sess1, &Subscribe{Request: 123, Topic: testTopic})
+		broker.Subscribe(sess2, &Subscribe{Request: 456, Topic: testTopic})
+		sub1 := subscriber1.received.(*Subscribed).Subscription
+		sub2 := subscriber2.received.(*Subscribed).Subscription
+
+		Convey("Both sessions should receive the same subscription ID", func() {
+			So(sub1, ShouldEqual, sub2)
+			So(broker.subscribers[sub1].subscribers, ShouldContainKey, sess1)
+			So(broker.subscribers[sub1].subscribers, ShouldContainKey, sess2)
+		})
+
+		Convey("The subscription should remain while it has subscribers", func() {
+			broker.Unsubscribe(sess1, &Unsubscribe{Request: 124, Subscription: sub1})
+			So(broker.routes, ShouldContainKey, testTopic)
+
+			broker.Unsubscribe(sess2, &Unsubscribe{Request: 457, Subscription: sub2})
+			So(broker.routes, ShouldNotContainKey, testTopic)
+			So(broker.subscriptions, ShouldNotContainKey, sub1)
+		})
+
+		Convey("Unsubscribing a session that isn't subscribed should fail", func() {
+			other := &TestPeer{}
+			broker.Unsubscribe(&Session{Peer: other}, &Unsubscribe{Request: 789, Subscription: sub1})
+			So(other.received.(*Error).Error, ShouldEqual, ErrNoSuchSubscription)
+		})
+	})
+}
+
+func TestPatternSubscribe(t *testing.T) {
+	Convey("Given a prefix and a wildcard subscription", t, func() {
+		broker := NewDefaultBroker().(*defaultBroker)
+		prefixPeer, wildcardPeer := &TestPeer{}, &TestPeer{}
+		prefixSess, wildcardSess := &Session{Peer: prefixPeer}, &Session{Peer: wildcardPeer}
+		broker.Subscribe(prefixSess, &Subscribe{
+			Request: 123,
+			Options: map[string]interface{}{"match": "prefix"},
+			Topic:   URI("com.acme.device"),
+		})
+		broker.Subscribe(wildcardSess, &Subscribe{
+			Request: 456,
+			Options: map[string]interface{}{"match": "wildcard"},
+			Topic:   URI("com.acme.device..status"),
+		})
+		prefixSub := prefixPeer.received.(*Subscribed).Subscription
+		wildcardSub := wildcardPeer.received.(*Subscribed).Subscription
+		So(broker.prefixRoutes, ShouldContainKey, URI("com.acme.device"))
+		So(broker.wildcardRoutes, ShouldContainKey, URI("com.acme.device..status"))
+
+		Convey("Publishing to a topic matching both patterns", func() {
+			topic := URI("com.acme.device.42.status")
+			broker.Publish(&Session{Peer: &TestPeer{}}, &Publish{Request: 789, Topic: topic})
+
+			Convey("Both subscribers should receive the event with the concrete topic", func() {
+				event := prefixPeer.received.(*Event)
+				So(event.Subscription, ShouldEqual, prefixSub)
+				So(event.Details["topic"], ShouldEqual, topic)
+				event = wildcardPeer.received.(*Event)
+				So(event.Subscription, ShouldEqual, wildcardSub)
+				So(event.Details["topic"], ShouldEqual, topic)
+			})
+		})
+
+		Convey("Publishing to a topic matching only the prefix", func() {
+			topic := URI("com.acme.device.42.status.battery")
+			broker.Publish(&Session{Peer: &TestPeer{}}, &Publish{Request: 789, Topic: topic})
+
+			Convey("Only the prefix subscriber should receive the event", func() {
+				So(prefixPeer.received.MessageType(), ShouldEqual, EVENT)
+				So(wildcardPeer.received.MessageType(), ShouldEqual, SUBSCRIBED)
+			})
+		})
+
+		Convey("Subscribing with an unknown match policy should fail", func() {
+			peer := &TestPeer{}
+			broker.Subscribe(&Session{Peer: peer}, &Subscribe{
+				Request: 111,
+				Options: map[string]interface{}{"match": "regex"},
+				Topic:   URI("com.acme.*"),
+			})
+			So(peer.received.(*Error).Error, ShouldEqual, ErrInvalidArgument)
+		})
+	})
+}
+
+func TestMatchWildcard(t *testing.T) {
+	tests := []struct {
+		pattern, uri URI
+		match        bool
+	}{
+		{"com.acme..status", "com.acme.42.status", true},
+		{"com.acme..status", "com.acme.42.state", false},
+		{"com.acme..status", "com.acme.42.status.battery", false},
+		{"..", "a.b.c", true},
+		{"com.acme.device", "com.acme.device", true},
+	}
+	for _, tst := range tests {
+		if matchWildcard(tst.pattern, tst.uri) != tst.match {
+			t.Errorf("matchWildcard(%q, %q) != %v", tst.pattern, tst.uri, tst.match)
+		}
+	}
+}
+
+func TestPublishBlackWhiteListing(t *testing.T) {
+	Convey("Given three subscribers with different authids and authroles", t, func() {
+		broker := NewDefaultBroker().(*defaultBroker)
+		peers := []*TestPeer{{}, {}, {}}
+		sessions := []*Session{
+			{Peer: peers[0], Id: 1, AuthId: "alice", AuthRole: "admin"},
+			{Peer: peers[1], Id: 2, AuthId: "bob", AuthRole: "user"},
+			{Peer: peers[2], Id: 3, AuthId: "carol", AuthRole: "user"},
+		}
+		topic := URI("com.acme.notification")
+		for _, sess := range sessions {
+			broker.Subscribe(sess, &Subscribe{Request: 123, Topic: topic})
+		}
+		publish := func(options map[string]interface{}) []bool {
+			broker.Publish(&Session{Peer: &TestPeer{}}, &Publish{Request: 456, Topic: topic, Options: options})
+			received := make([]bool, len(peers))
+			for i, peer := range peers {
+				received[i] = peer.received.MessageType() == EVENT
+			}
+			return received
+		}
+
+		Convey("Excluded sessions should not receive the event", func() {
+			So(publish(map[string]interface{}{"exclude": []interface{}{2}}), ShouldResemble, []bool{true, false, true})
+		})
+
+		Convey("Only eligible sessions should receive the event", func() {
+			So(publish(map[string]interface{}{"eligible": []ID{1, 3}}), ShouldResemble, []bool{true, false, true})
+		})
+
+		Convey("Sessions with an excluded authid should not receive the event", func() {
+			So(publish(map[string]interface{}{"exclude_authid": []string{"alice"}}), ShouldResemble, []bool{false, true, true})
+		})
+
+		Convey("Only sessions with an eligible authrole should receive the event", func() {
+			So(publish(map[string]interface{}{"eligible_authrole": []interface{}{"user"}}), ShouldResemble, []bool{false, true, true})
+		})
+
+		Convey("Blacklists should take precedence over whitelists", func() {
+			options := map[string]interface{}{
+				"eligible_authrole": []string{"user"},
+				"exclude_authid":    []string{"carol"},
+			}
+			So(publish(options), ShouldResemble, []bool{false, true, false})
+		})
+	})
+}
+
+func TestPublisherDisclosure(t *testing.T) {
+	Convey("Given a subscriber and a publisher", t, func() {
+		broker := NewDefaultBroker().(*defaultBroker)
+		subscriber := &TestPeer{}
+		topic := URI("com.acme.chat")
+		broker.Subscribe(&Session{Peer: subscriber}, &Subscribe{Request: 123, Topic: topic})
+		pub := &Session{Peer: &TestPeer{}, Id: 42, AuthId: "alice", AuthRole: "user"}
+
+		Convey("A publisher asking for disclosure should be disclosed", func() {
+			broker.Publish(pub, &Publish{Request: 456, Topic: topic, Options: map[string]interface{}{"disclose_me": true}})
+			details := subscriber.received.(*Event).Details
+			So(details["publisher"], ShouldEqual, 42)
+			So(details["publisher_authid"], ShouldEqual, "alice")
+			So(details["publisher_authrole"], ShouldEqual, "user")
+		})
+
+		Convey("Other publishers should not be disclosed", func() {
+			broker.Publish(pub, &Publish{Request: 456, Topic: topic})
+			So(subscriber.received.(*Event).Details, ShouldBeEmpty)
+		})
+	})
+}
+
+func TestRetainedEvents(t *testing.T) {
+	Convey("Given a retained event", t, func() {
+		broker := NewDefaultBroker().(*defaultBroker)
+		topic := URI("com.acme.device.status")
+		broker.setHistory(map[URI]EventHistory{topic: {Limit: 1, MaxAge: time.Minute}})
+		broker.Publish(&Session{Peer: &TestPeer{}}, &Publish{
+			Request:   123,
+			Topic:     topic,
+			Options:   map[string]interface{}{"retain": true},
+			Arguments: []interface{}{"online"},
+		})
+
+		Convey("A subscriber asking for retained events should receive it", func() {
+			subscriber := &TestPeer{}
+			broker.Subscribe(&Session{Peer: subscriber}, &Subscribe{
+				Request: 456,
+				Topic:   topic,
+				Options: map[string]interface{}{"get_retained": true},
+			})
+			event := subscriber.received.(*Event)
+			So(event.Arguments, ShouldResemble, []interface{}{"online"})
+			So(event.Details["retained"], ShouldEqual, true)
+		})
+
+		Convey("Other subscribers should not receive it", func() {
+			subscriber := &TestPeer{}
+			broker.Subscribe(&Session{Peer: subscriber}, &Subscribe{Request: 456, Topic: topic})
+			So(subscriber.received.MessageType(), ShouldEqual, SUBSCRIBED)
+		})
+
+		Convey("It should be dropped once older than the maximum age", func() {
+			broker.retained[topic].timestamp = time.Now().Add(-2 * time.Minute)
+			subscriber := &TestPeer{}
+			broker.Subscribe(&Session{Peer: subscriber}, &Subscribe{
+				Request: 456,
+				Topic:   topic,
+				Options: map[string]interface{}{"get_retained": true},
+			})
+			So(subscriber.received.MessageType(), ShouldEqual, SUBSCRIBED)
+			So(broker.retained, ShouldBeEmpty)
+		})
+
+		Convey("Events on topics without a history should not be retained", func() {
+			broker.Publish(&Session{Peer: &TestPeer{}}, &Publish{
+				Request: 789,
+				Topic:   "com.acme.device.other",
+				Options: map[string]interface{}{"retain": true},
+			})
+			So(broker.retained, ShouldHaveLength, 1)
+		})
+	})
+}
+
+func TestEventHistory(t *testing.T) {
+	Convey("Given a topic that keeps its last two events", t, func() {
+		broker := NewDefaultBroker().(*defaultBroker)
+		topic := URI("com.acme.device.status")
+		broker.setHistory(map[URI]EventHistory{topic: {Limit: 2}})
+		subscriber := &TestPeer{}
+		broker.Subscribe(&Session{Peer: subscriber, Id: 1}, &Subscribe{Request: 123, Topic: topic})
+		sub := subscriber.received.(*Subscribed).Subscription
+		details := map[string]interface{}{"caller": ID(1)}
+
+		for _, status := range []string{"booting", "online", "offline"} {
+			broker.Publish(&Session{Peer: &TestPeer{}}, &Publish{Request: 456, Topic: topic, Arguments: []interface{}{status}})
+		}
+
+		Convey("wamp.subscription.get_events should return the last two events", func() {
+			result := broker.subscriptionGetEvents([]interface{}{sub}, nil, details)
+			So(result.Err, ShouldEqual, "")
+			events := result.Args[0].([]interface{})
+			So(events, ShouldHaveLength, 2)
+			So(events[0].(map[string]interface{})["args"], ShouldResemble, []interface{}{"online"})
+			So(events[1].(map[string]interface{})["args"], ShouldResemble, []interface{}{"offline"})
+		})
+
+		Convey("wamp.subscription.get_events should honour the limit", func() {
+			result := broker.subscriptionGetEvents([]interface{}{sub, 1}, nil, details)
+			events := result.Args[0].([]interface{})
+			So(events, ShouldHaveLength, 1)
+			So(events[0].(map[string]interface{})["args"], ShouldResemble, []interface{}{"offline"})
+		})
+
+		Convey("wamp.subscription.get_events should fail for other sessions", func() {
+			result := broker.subscriptionGetEvents([]interface{}{sub}, nil, map[string]interface{}{"caller": ID(2)})
+			So(result.Err, ShouldEqual, ErrNotAuthorized)
+		})
+	})
+
+	Convey("Events older than the maximum age should be dropped", t, func() {
+		now := time.Now()
+		h := &eventHistory{EventHistory: EventHistory{MaxAge: time.Minute}}
+		h.add(&storedEvent{publication: 1, timestamp: now.Add(-2 * time.Minute)})
+		h.add(&storedEvent{publication: 2, timestamp: now})
+		So(h.events, ShouldHaveLength, 1)
+		So(h.events[0].publication, ShouldEqual, 2)
+	})
+}
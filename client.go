@@ -4,6 +4,7 @@ import (
 	"crypto/tls"
 	"fmt"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -35,21 +36,32 @@ type Client struct {
 	Auth map[string]AuthFunc
 	// ReceiveDone is notified when the client's connection to the router is lost.
 	ReceiveDone  chan bool
-	listeners    map[ID]chan Message
+	listeners    map[ID]*listener
 	events       map[ID]*eventDesc
 	procedures   map[ID]*procedureDesc
 	acts         chan func()
 	requestCount uint
+	// interrupt channels of the invocations that are in progress
+	invocations     map[ID]chan struct{}
+	invocationsLock sync.Mutex
+}
+
+// a listener waits for the router's response to a request
+type listener struct {
+	messages chan Message
+	// closed once the listener is removed, so that messages that arrive late
+	// are dropped
+	removed chan struct{}
 }
 
 type procedureDesc struct {
 	name    string
-	handler MethodHandler
+	handler ProgressiveMethodHandler
 }
 
 type eventDesc struct {
 	topic   string
-	handler EventHandler
+	handler EventDetailsHandler
 }
 
 // NewWebsocketClient creates a new websocket client connected to the specified
@@ -67,11 +79,12 @@ func NewClient(p Peer) *Client {
 	c := &Client{
 		Peer:           p,
 		ReceiveTimeout: 10 * time.Second,
-		listeners:      make(map[ID]chan Message),
+		listeners:      make(map[ID]*listener),
 		events:         make(map[ID]*eventDesc),
 		procedures:     make(map[ID]*procedureDesc),
 		acts:           make(chan func()),
 		requestCount:   0,
+		invocations:    make(map[ID]chan struct{}),
 	}
 	go c.run()
 	return c
@@ -82,8 +95,8 @@ func (c *Client) run() {
 		if act, ok := <-c.acts; ok {
 			act()
 		} else {
-			for _, lc := range c.listeners {
-				close(lc)
+			for _, l := range c.listeners {
+				close(l.messages)
 			}
 			return
 		}
@@ -139,6 +152,10 @@ func (c *Client) joinRealmCRA(realm string, details map[string]interface{}) (map
 		c.Peer.Close()
 		close(c.acts)
 		return nil, err
+	} else if welcome, ok := msg.(*Welcome); ok {
+		// the router welcomed the client without a challenge, e.g. anonymously
+		go c.Receive()
+		return welcome.Details, nil
 	} else if challenge, ok := msg.(*Challenge); !ok {
 		c.Send(abortUnexpectedMsg)
 		c.Peer.Close()
@@ -176,10 +193,32 @@ func (c *Client) joinRealmCRA(realm string, details map[string]interface{}) (map
 
 func clientRoles() map[string]map[string]interface{} {
 	return map[string]map[string]interface{}{
-		"publisher":  make(map[string]interface{}),
-		"subscriber": make(map[string]interface{}),
-		"callee":     make(map[string]interface{}),
-		"caller":     make(map[string]interface{}),
+		"publisher": {
+			"features": map[string]interface{}{
+				"subscriber_blackwhite_listing": true,
+				"publisher_identification":      true,
+			},
+		},
+		"subscriber": {
+			"features": map[string]interface{}{
+				"pattern_based_subscription": true,
+				"publisher_identification":   true,
+			},
+		},
+		"callee": {
+			"features": map[string]interface{}{
+				"shared_registration":        true,
+				"pattern_based_registration": true,
+				"call_canceling":             true,
+				"progressive_call_results":   true,
+			},
+		},
+		"caller": {
+			"features": map[string]interface{}{
+				"call_canceling":           true,
+				"progressive_call_results": true,
+			},
+		},
 	}
 }
 
@@ -244,6 +283,8 @@ func (c *Client) Receive() {
 
 		case *Invocation:
 			c.handleInvocation(msg)
+		case *Interrupt:
+			c.handleInterrupt(msg)
 
 		case *Registered:
 			c.notifyListener(msg, msg.Request)
@@ -279,7 +320,7 @@ func (c *Client) handleEvent(msg *Event) {
 	sync := make(chan struct{})
 	c.acts <- func() {
 		if event, ok := c.events[msg.Subscription]; ok {
-			go event.handler(msg.Arguments, msg.ArgumentsKw)
+			go event.handler(msg.Arguments, msg.ArgumentsKw, msg.Details)
 		} else {
 			log.Println("no handler registered for subscription:", msg.Subscription)
 		}
@@ -292,7 +333,7 @@ func (c *Client) notifyListener(msg Message, requestID ID) {
 	// pass in the request ID so we don't have to do any type assertion
 	var (
 		sync = make(chan struct{})
-		l    chan Message
+		l    *listener
 		ok   bool
 	)
 	c.acts <- func() {
@@ -301,7 +342,11 @@ func (c *Client) notifyListener(msg Message, requestID ID) {
 	}
 	<-sync
 	if ok {
-		l <- msg
+		select {
+		case l.messages <- msg:
+		case <-l.removed:
+			log.Println("listener removed before message", msg.MessageType(), requestID)
+		}
 	} else {
 		log.Println("no listener for message", msg.MessageType(), requestID)
 	}
@@ -311,8 +356,28 @@ func (c *Client) handleInvocation(msg *Invocation) {
 	sync := make(chan struct{})
 	c.acts <- func() {
 		if proc, ok := c.procedures[msg.Registration]; ok {
+			interrupt := make(chan struct{})
+			c.invocationsLock.Lock()
+			c.invocations[msg.Request] = interrupt
+			c.invocationsLock.Unlock()
 			go func() {
-				result := proc.handler(msg.Arguments, msg.ArgumentsKw, msg.Details)
+				receiveProgress, _ := msg.Details["receive_progress"].(bool)
+				progress := func(args []interface{}, kwargs map[string]interface{}) error {
+					if !receiveProgress {
+						return nil
+					}
+					return c.Send(&Yield{
+						Request:     msg.Request,
+						Options:     map[string]interface{}{"progress": true},
+						Arguments:   args,
+						ArgumentsKw: kwargs,
+					})
+				}
+				result := proc.handler(msg.Arguments, msg.ArgumentsKw, msg.Details, progress, interrupt)
+
+				c.invocationsLock.Lock()
+				delete(c.invocations, msg.Request)
+				c.invocationsLock.Unlock()
 
 				var tosend Message
 				tosend = &Yield{
@@ -333,6 +398,18 @@ func (c *Client) handleInvocation(msg *Invocation) {
 					}
 				}
 
+				select {
+				case <-interrupt:
+					// the router is no longer interested in the result
+					tosend = &Error{
+						Type:    INVOCATION,
+						Request: msg.Request,
+						Details: make(map[string]interface{}),
+						Error:   ErrCanceled,
+					}
+				default:
+				}
+
 				if err := c.Send(tosend); err != nil {
 					log.Println("error sending message:", err)
 				}
@@ -353,51 +430,104 @@ func (c *Client) handleInvocation(msg *Invocation) {
 	<-sync
 }
 
+func (c *Client) handleInterrupt(msg *Interrupt) {
+	c.invocationsLock.Lock()
+	defer c.invocationsLock.Unlock()
+	if interrupt, ok := c.invocations[msg.Request]; ok {
+		close(interrupt)
+		delete(c.invocations, msg.Request)
+	} else {
+		log.Println("no invocation in progress for interrupt:", msg.Request)
+	}
+}
+
 func (c *Client) registerListener(id ID) {
 	log.Println("register listener:", id)
-	wait := make(chan Message, 1)
+	l := &listener{messages: make(chan Message, 1), removed: make(chan struct{})}
 	sync := make(chan struct{})
 	c.acts <- func() {
-		c.listeners[id] = wait
+		c.listeners[id] = l
 		sync <- struct{}{}
 	}
 	<-sync
 }
 
+// removeListener removes a listener, and drops the messages still on their
+// way to it.
+func (c *Client) removeListener(id ID) {
+	c.acts <- func() {
+		if l, ok := c.listeners[id]; ok {
+			delete(c.listeners, id)
+			close(l.removed)
+		}
+	}
+}
+
 func (c *Client) waitOnListener(id ID) (msg Message, err error) {
+	msg, err = c.receiveOnListener(id, nil, c.ReceiveTimeout)
+	c.removeListener(id)
+	return
+}
+
+// errListenerCanceled is returned by receiveOnListener when the cancel channel
+// is closed before a message is received.
+var errListenerCanceled = fmt.Errorf("canceled while waiting for message")
+
+// receiveOnListener waits for the next message on the listener without
+// removing it, for up to the timeout, or without a timeout if it is 0.
+func (c *Client) receiveOnListener(id ID, cancel <-chan struct{}, timeout time.Duration) (msg Message, err error) {
 	log.Println("wait on listener:", id)
 	var (
 		sync = make(chan struct{})
-		wait chan Message
+		l    *listener
 		ok   bool
 	)
 	c.acts <- func() {
-		wait, ok = c.listeners[id]
+		l, ok = c.listeners[id]
 		sync <- struct{}{}
 	}
 	<-sync
 	if !ok {
 		return nil, fmt.Errorf("unknown listener ID: %v", id)
 	}
+	var timedOut <-chan time.Time
+	if timeout > 0 {
+		timedOut = time.After(timeout)
+	}
 	select {
-	case msg, ok = <-wait:
+	case msg, ok = <-l.messages:
 		if !ok {
 			return nil, fmt.Errorf("listener closed while waiting for message")
 		}
-	case <-time.After(c.ReceiveTimeout):
+	case <-cancel:
+		err = errListenerCanceled
+	case <-timedOut:
 		err = fmt.Errorf("timeout while waiting for message")
 	}
-	c.acts <- func() {
-		delete(c.listeners, id)
-	}
 	return
 }
 
 // EventHandler handles a publish event.
 type EventHandler func(args []interface{}, kwargs map[string]interface{})
 
+// EventDetailsHandler handles a publish event and receives the EVENT details,
+// e.g. the topic of an event received through a pattern-based subscription.
+type EventDetailsHandler func(args []interface{}, kwargs map[string]interface{}, details map[string]interface{})
+
 // Subscribe registers the EventHandler to be called for every message in the provided topic.
 func (c *Client) Subscribe(topic string, options map[string]interface{}, fn EventHandler) error {
+	wrap := func(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) {
+		fn(args, kwargs)
+	}
+	return c.SubscribeWithDetails(topic, options, wrap)
+}
+
+// SubscribeWithDetails registers the EventDetailsHandler to be called for every
+// message in the provided topic.
+//
+// Set options["match"] to "prefix" or "wildcard" to subscribe to a pattern
+// instead of a single topic.
+func (c *Client) SubscribeWithDetails(topic string, options map[string]interface{}, fn EventDetailsHandler) error {
 	if options == nil {
 		options = make(map[string]interface{})
 	}
@@ -487,8 +617,45 @@ type MethodHandler func(
 	args []interface{}, kwargs map[string]interface{}, details map[string]interface{},
 ) (result *CallResult)
 
+// InterruptibleMethodHandler is an RPC endpoint that is notified when the
+// router interrupts the invocation, e.g. because the caller canceled the call.
+//
+// The interrupt channel is closed when the invocation is interrupted. The
+// result of an interrupted invocation is discarded.
+type InterruptibleMethodHandler func(
+	args []interface{}, kwargs map[string]interface{}, details map[string]interface{}, interrupt <-chan struct{},
+) (result *CallResult)
+
+// ProgressiveMethodHandler is an interruptible RPC endpoint that can send
+// progressive results to the caller before returning the final result.
+//
+// Calling progress sends a progressive result if the caller asked to receive
+// them, otherwise it does nothing.
+type ProgressiveMethodHandler func(
+	args []interface{}, kwargs map[string]interface{}, details map[string]interface{},
+	progress func(args []interface{}, kwargs map[string]interface{}) error, interrupt <-chan struct{},
+) (result *CallResult)
+
 // Register registers a MethodHandler procedure with the router.
 func (c *Client) Register(procedure string, fn MethodHandler, options map[string]interface{}) error {
+	wrap := func(args []interface{}, kwargs map[string]interface{},
+		details map[string]interface{}, interrupt <-chan struct{}) (result *CallResult) {
+		return fn(args, kwargs, details)
+	}
+	return c.RegisterInterruptible(procedure, wrap, options)
+}
+
+// RegisterInterruptible registers an InterruptibleMethodHandler procedure with the router.
+func (c *Client) RegisterInterruptible(procedure string, fn InterruptibleMethodHandler, options map[string]interface{}) error {
+	wrap := func(args []interface{}, kwargs map[string]interface{}, details map[string]interface{},
+		progress func([]interface{}, map[string]interface{}) error, interrupt <-chan struct{}) (result *CallResult) {
+		return fn(args, kwargs, details, interrupt)
+	}
+	return c.RegisterProgressive(procedure, wrap, options)
+}
+
+// RegisterProgressive registers a ProgressiveMethodHandler procedure with the router.
+func (c *Client) RegisterProgressive(procedure string, fn ProgressiveMethodHandler, options map[string]interface{}) error {
 	id := NewID()
 	c.registerListener(id)
 	register := &Register{
@@ -608,8 +775,49 @@ func (rpc RPCError) Error() string {
 
 // Call calls a procedure given a URI.
 func (c *Client) Call(procedure string, options map[string]interface{}, args []interface{}, kwargs map[string]interface{}) (*Result, error) {
+	return c.CallWithCancel(procedure, options, args, kwargs, nil, "")
+}
+
+// CallWithCancel calls a procedure given a URI, and cancels the call if the
+// cancel channel is closed before the result is received.
+//
+// mode is the cancel mode sent to the router: CancelSkip, CancelKill or
+// CancelKillNoWait. If it's empty, the router's default mode is used. A
+// canceled call returns an RPCError with the wamp.error.canceled error URI.
+func (c *Client) CallWithCancel(procedure string, options map[string]interface{}, args []interface{}, kwargs map[string]interface{},
+	cancel <-chan struct{}, mode string) (*Result, error) {
+	return c.call(procedure, options, args, kwargs, cancel, mode, nil)
+}
+
+// CallProgressive calls a procedure given a URI, and asks the callee to send
+// progressive results. Each progressive result is passed to the progress
+// function, and the final result is returned once the progress function has
+// handled all of them.
+//
+// The progress function is called in order from another goroutine, so it may
+// block, or make calls with the client, without holding up the other messages
+// to the client.
+//
+// The client's ReceiveTimeout only applies until the first progressive result
+// arrives, as progressive results may be far apart. Use the cancel channel, or
+// the "timeout" option, to limit the duration of the whole call.
+//
+// If the cancel channel is closed before the final result is received, the
+// call is canceled with the router's default cancel mode. cancel may be nil.
+func (c *Client) CallProgressive(procedure string, options map[string]interface{}, args []interface{}, kwargs map[string]interface{},
+	progress func(*Result), cancel <-chan struct{}) (*Result, error) {
+	if options == nil {
+		options = make(map[string]interface{})
+	}
+	options["receive_progress"] = true
+	return c.call(procedure, options, args, kwargs, cancel, "", progress)
+}
+
+func (c *Client) call(procedure string, options map[string]interface{}, args []interface{}, kwargs map[string]interface{},
+	cancel <-chan struct{}, mode string, progress func(*Result)) (*Result, error) {
 	id := NewID()
 	c.registerListener(id)
+	defer c.removeListener(id)
 
 	call := &Call{
 		Request:     id,
@@ -623,15 +831,98 @@ func (c *Client) Call(procedure string, options map[string]interface{}, args []i
 		return nil, err
 	}
 
+	var progressResults chan<- *Result
+	if progress != nil {
+		results, done := handleProgress(progress)
+		progressResults = results
+		defer func() {
+			close(results)
+			<-done
+		}()
+	}
+
 	// wait to receive RESULT message
-	var msg Message
-	if msg, err = c.waitOnListener(id); err != nil {
+	var (
+		msg      Message
+		timeout  = c.ReceiveTimeout
+		canceled = false
+	)
+	for {
+		msg, err = c.receiveOnListener(id, cancel, timeout)
+		if result, ok := msg.(*Result); ok && err == nil {
+			if isProgress, _ := result.Details["progress"].(bool); isProgress {
+				if progressResults != nil {
+					progressResults <- result
+				}
+				// the next progressive result may take any time to arrive
+				timeout = 0
+				continue
+			}
+		}
+		if err != errListenerCanceled {
+			break
+		}
+		cancelOptions := make(map[string]interface{})
+		if mode != "" {
+			cancelOptions["mode"] = mode
+		}
+		if err := c.Send(&Cancel{Request: id, Options: cancelOptions}); err != nil {
+			return nil, err
+		}
+		canceled = true
+		// keep waiting for the router to respond to the cancellation
+		cancel = nil
+		timeout = c.ReceiveTimeout
+	}
+	if err != nil {
+		// stop the call, so that the callee doesn't keep working for nothing
+		if !canceled {
+			logErr(c.Send(&Cancel{Request: id, Options: make(map[string]interface{})}))
+		}
 		return nil, err
 	} else if e, ok := msg.(*Error); ok {
 		return nil, RPCError{e, procedure}
 	} else if result, ok := msg.(*Result); !ok {
-		return nil, fmt.Errorf(formatUnexpectedMessage(msg, RESULT))
+		return nil, fmt.Errorf("%s", formatUnexpectedMessage(msg, RESULT))
 	} else {
 		return result, nil
 	}
 }
+
+// handleProgress passes the progressive results sent on the returned channel
+// to the progress function, in order and from another goroutine, queueing the
+// results that arrive while it is busy. done is closed once the results
+// channel is closed and the progress function has handled every result.
+func handleProgress(progress func(*Result)) (results chan<- *Result, done <-chan struct{}) {
+	in, out, finished := make(chan *Result), make(chan *Result), make(chan struct{})
+	go func() {
+		defer close(out)
+		var queue []*Result
+		for recv := in; recv != nil || len(queue) > 0; {
+			var (
+				send chan *Result
+				next *Result
+			)
+			if len(queue) > 0 {
+				send, next = out, queue[0]
+			}
+			select {
+			case result, ok := <-recv:
+				if !ok {
+					recv = nil
+				} else {
+					queue = append(queue, result)
+				}
+			case send <- next:
+				queue = queue[1:]
+			}
+		}
+	}()
+	go func() {
+		defer close(finished)
+		for result := range out {
+			progress(result)
+		}
+	}()
+	return in, finished
+}
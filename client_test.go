@@ -61,6 +61,22 @@ func TestJoinRealmWithAuth(t *testing.T) {
 			So(err, ShouldBeNil)
 		})
 	})
+
+	Convey("Given a server that lets clients in anonymously", t, func() {
+		router := newTestRouter()
+		router.RegisterRealm(URI("turnpike.test.auth"), Realm{
+			CRAuthenticators:     map[string]CRAuthenticator{"testauth": &testCRAuthenticator{}},
+			DefaultAuthenticator: NewAnonymousAuthenticator(""),
+		})
+
+		Convey("A client that fails to authenticate should join without a challenge", func() {
+			client := NewClient(router.getTestPeer())
+			client.Auth = map[string]AuthFunc{"testauth": testAuthFunc}
+			details, err := client.JoinRealm("turnpike.test.auth", map[string]interface{}{})
+			So(err, ShouldBeNil)
+			So(details["authrole"], ShouldEqual, "anonymous")
+		})
+	})
 }
 
 func TestRemoteCall(t *testing.T) {
@@ -114,3 +130,142 @@ func TestRemoteCall(t *testing.T) {
 		})
 	})
 }
+
+func TestCancelRemoteCall(t *testing.T) {
+	Convey("Given a callee with a long-running interruptible method", t, func() {
+		callee, caller := connectedTestClients()
+		interrupted := make(chan struct{})
+		handler := func(args []interface{}, kwargs map[string]interface{},
+			details map[string]interface{}, interrupt <-chan struct{}) *CallResult {
+			<-interrupt
+			close(interrupted)
+			return &CallResult{Args: []interface{}{"too late"}}
+		}
+		err := callee.RegisterInterruptible("report", handler, nil)
+		So(err, ShouldBeNil)
+
+		Convey("Canceling the call should interrupt the callee", func() {
+			cancel := make(chan struct{})
+			close(cancel)
+			result, err := caller.CallWithCancel("report", nil, nil, nil, cancel, CancelKill)
+			So(result, ShouldBeNil)
+			So(err, ShouldHaveSameTypeAs, RPCError{})
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrCanceled)
+
+			select {
+			case <-interrupted:
+			case <-time.After(100 * time.Millisecond):
+				t.Error("callee was not interrupted")
+			}
+		})
+	})
+}
+
+func TestProgressiveRemoteCall(t *testing.T) {
+	Convey("Given a callee that sends progressive results", t, func() {
+		callee, caller := connectedTestClients()
+		handler := func(args []interface{}, kwargs map[string]interface{}, details map[string]interface{},
+			progress func([]interface{}, map[string]interface{}) error, interrupt <-chan struct{}) *CallResult {
+			for i := 1; i <= 3; i++ {
+				progress([]interface{}{i}, nil)
+			}
+			return &CallResult{Args: []interface{}{"done"}}
+		}
+		err := callee.RegisterProgressive("export", handler, nil)
+		So(err, ShouldBeNil)
+
+		Convey("A progressive call should receive each result", func() {
+			var received []interface{}
+			result, err := caller.CallProgressive("export", nil, nil, nil, func(r *Result) {
+				received = append(received, r.Arguments[0])
+			}, nil)
+			So(err, ShouldBeNil)
+			So(result.Arguments[0], ShouldEqual, "done")
+			So(received, ShouldResemble, []interface{}{1, 2, 3})
+		})
+
+		Convey("A progress function that makes calls should not block the client", func() {
+			caller.ReceiveTimeout = time.Second
+			var finals []interface{}
+			result, err := caller.CallProgressive("export", nil, nil, nil, func(r *Result) {
+				if result, err := caller.Call("export", nil, nil, nil); err == nil {
+					finals = append(finals, result.Arguments[0])
+				}
+			}, nil)
+			So(err, ShouldBeNil)
+			So(result.Arguments[0], ShouldEqual, "done")
+			So(finals, ShouldResemble, []interface{}{"done", "done", "done"})
+		})
+
+		Convey("A regular call should only receive the final result", func() {
+			result, err := caller.Call("export", nil, nil, nil)
+			So(err, ShouldBeNil)
+			So(result.Arguments[0], ShouldEqual, "done")
+		})
+	})
+}
+
+func TestCallGivingUp(t *testing.T) {
+	Convey("Given a callee with a method that waits to be interrupted", t, func() {
+		callee, caller := connectedTestClients()
+		interrupted := make(chan struct{})
+		handler := func(args []interface{}, kwargs map[string]interface{},
+			details map[string]interface{}, interrupt <-chan struct{}) *CallResult {
+			<-interrupt
+			close(interrupted)
+			return &CallResult{}
+		}
+		So(callee.RegisterInterruptible("wait", handler, nil), ShouldBeNil)
+
+		Convey("A call that times out should cancel the invocation", func() {
+			caller.ReceiveTimeout = 50 * time.Millisecond
+			_, err := caller.Call("wait", nil, nil, nil)
+			So(err, ShouldNotBeNil)
+
+			select {
+			case <-interrupted:
+			case <-time.After(time.Second):
+				t.Error("callee was not interrupted")
+			}
+		})
+	})
+
+	Convey("Given a callee that sends progressive results slowly", t, func() {
+		callee, caller := connectedTestClients()
+		handler := func(args []interface{}, kwargs map[string]interface{}, details map[string]interface{},
+			progress func([]interface{}, map[string]interface{}) error, interrupt <-chan struct{}) *CallResult {
+			progress([]interface{}{1}, nil)
+			time.Sleep(150 * time.Millisecond)
+			return &CallResult{Args: []interface{}{"done"}}
+		}
+		So(callee.RegisterProgressive("tail", handler, nil), ShouldBeNil)
+
+		Convey("The receive timeout should not apply between progressive results", func() {
+			caller.ReceiveTimeout = 50 * time.Millisecond
+			result, err := caller.CallProgressive("tail", nil, nil, nil, func(*Result) {}, nil)
+			So(err, ShouldBeNil)
+			So(result.Arguments[0], ShouldEqual, "done")
+		})
+	})
+
+	Convey("A message waiting for a listener that is removed should be dropped", t, func() {
+		client := NewClient(&TestPeer{})
+		id := NewID()
+		client.registerListener(id)
+		client.notifyListener(&Result{Request: id}, id)
+
+		done := make(chan struct{})
+		go func() {
+			// the listener's buffer is full, so this waits
+			client.notifyListener(&Result{Request: id}, id)
+			close(done)
+		}()
+		time.Sleep(10 * time.Millisecond)
+		client.removeListener(id)
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("notifying a removed listener blocked")
+		}
+	})
+}
@@ -0,0 +1,189 @@
+package turnpike
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// CookieIdentity is the identity a cookie is bound to once its client has
+// authenticated.
+type CookieIdentity struct {
+	AuthId     string `json:"authid"`
+	AuthRole   string `json:"authrole"`
+	AuthMethod string `json:"authmethod"`
+	Realm      string `json:"realm"`
+	// Expires is when the cookie stops authenticating, zero for never.
+	Expires time.Time `json:"expires"`
+}
+
+func (id *CookieIdentity) expired(now time.Time) bool {
+	return !id.Expires.IsZero() && now.After(id.Expires)
+}
+
+// CookieStore keeps the identities bound to authentication cookies.
+type CookieStore interface {
+	// Get returns the identity bound to a cookie, or nil if it isn't bound or
+	// has expired.
+	Get(cookie string) (*CookieIdentity, error)
+	// Set binds a cookie to an identity.
+	Set(cookie string, id *CookieIdentity) error
+	// Delete unbinds a cookie.
+	Delete(cookie string) error
+}
+
+type memoryCookieStore struct {
+	cookies map[string]*CookieIdentity
+	lock    sync.Mutex
+}
+
+// NewMemoryCookieStore creates a CookieStore that keeps cookies in memory, so
+// they stop authenticating when the router restarts.
+func NewMemoryCookieStore() CookieStore {
+	return &memoryCookieStore{cookies: make(map[string]*CookieIdentity)}
+}
+
+func (s *memoryCookieStore) Get(cookie string) (*CookieIdentity, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	id, ok := s.cookies[cookie]
+	if !ok {
+		return nil, nil
+	}
+	if id.expired(time.Now()) {
+		delete(s.cookies, cookie)
+		return nil, nil
+	}
+	return id, nil
+}
+
+func (s *memoryCookieStore) Set(cookie string, id *CookieIdentity) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cookies[cookie] = id
+	return nil
+}
+
+func (s *memoryCookieStore) Delete(cookie string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.cookies, cookie)
+	return nil
+}
+
+type fileCookieStore struct {
+	memoryCookieStore
+	path string
+}
+
+// NewFileCookieStore creates a CookieStore that keeps cookies in a JSON file,
+// so they keep authenticating when the router restarts. The file is created
+// if it doesn't exist.
+func NewFileCookieStore(path string) (CookieStore, error) {
+	s := &fileCookieStore{
+		memoryCookieStore: memoryCookieStore{cookies: make(map[string]*CookieIdentity)},
+		path:              path,
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.cookies); err != nil {
+		return nil, fmt.Errorf("error parsing cookie file: %v", err)
+	}
+	return s, nil
+}
+
+func (s *fileCookieStore) Set(cookie string, id *CookieIdentity) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.cookies[cookie] = id
+	return s.save()
+}
+
+func (s *fileCookieStore) Delete(cookie string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.cookies, cookie)
+	return s.save()
+}
+
+// save writes the unexpired cookies to the file, replacing it atomically.
+func (s *fileCookieStore) save() error {
+	now := time.Now()
+	for cookie, id := range s.cookies {
+		if id.expired(now) {
+			delete(s.cookies, cookie)
+		}
+	}
+	data, err := json.Marshal(s.cookies)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+// newCookie returns a new random cookie value.
+func newCookie() (string, error) {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+type cookieAuthenticator struct {
+	cookies CookieStore
+}
+
+// NewCookieAuthenticator creates an authenticator, for the "cookie" authmethod,
+// that welcomes clients whose connection carries a cookie bound to an
+// identity. The store must be the CookieStore of the WebsocketServer, which
+// issues the cookies and binds them.
+func NewCookieAuthenticator(cookies CookieStore) Authenticator {
+	return &cookieAuthenticator{cookies: cookies}
+}
+
+func (a *cookieAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	transport, _ := details["transport"].(map[string]interface{})
+	cookie, _ := transport["cbtid"].(string)
+	if cookie == "" {
+		return nil, fmt.Errorf("no cookie provided")
+	}
+	id, err := a.cookies.Get(cookie)
+	if err != nil {
+		return nil, err
+	}
+	if id == nil {
+		return nil, fmt.Errorf("cookie is not authenticated")
+	}
+	if realm, _ := details["realm"].(URI); id.Realm != string(realm) {
+		return nil, fmt.Errorf("cookie is not authenticated for %s", realm)
+	}
+	return map[string]interface{}{
+		"authid":       id.AuthId,
+		"authrole":     id.AuthRole,
+		"authprovider": "cookie",
+	}, nil
+}
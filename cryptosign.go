@@ -0,0 +1,137 @@
+package turnpike
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+)
+
+// CryptosignPrincipal is the identity of a client that authenticates with a
+// cryptosign key.
+type CryptosignPrincipal struct {
+	AuthId   string
+	AuthRole string
+}
+
+// CryptosignKeyStore looks up the public keys that can authenticate with
+// cryptosign.
+type CryptosignKeyStore interface {
+	// GetPrincipal returns the identity registered for the hex-encoded Ed25519
+	// public key, or an error if the key is not registered.
+	GetPrincipal(pubkey string) (*CryptosignPrincipal, error)
+}
+
+// CryptosignKeyMap is a CryptosignKeyStore that maps hex-encoded public keys
+// to identities.
+type CryptosignKeyMap map[string]*CryptosignPrincipal
+
+// GetPrincipal returns the identity registered for the public key.
+func (m CryptosignKeyMap) GetPrincipal(pubkey string) (*CryptosignPrincipal, error) {
+	if principal, ok := m[pubkey]; ok {
+		return principal, nil
+	}
+	return nil, fmt.Errorf("unknown public key: %s", pubkey)
+}
+
+type cryptosignAuthenticator struct {
+	keys CryptosignKeyStore
+}
+
+// NewCryptosignAuthenticator creates a WAMP-Cryptosign authenticator, for the
+// "cryptosign" authmethod, that authenticates clients holding the private key
+// of a public key in the store.
+//
+// Clients provide their hex-encoded public key in the HELLO details as
+// authextra.pubkey, and sign the challenge with their private key, which
+// CryptosignAuthFunc does for turnpike clients.
+func NewCryptosignAuthenticator(keys CryptosignKeyStore) CRAuthenticator {
+	return &cryptosignAuthenticator{keys: keys}
+}
+
+func (a *cryptosignAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	authextra, _ := details["authextra"].(map[string]interface{})
+	pubkey, _ := authextra["pubkey"].(string)
+	if pubkey == "" {
+		return nil, fmt.Errorf("no public key provided")
+	}
+	principal, err := a.keys.GetPrincipal(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	if authid, ok := details["authid"].(string); ok && authid != principal.AuthId {
+		return nil, fmt.Errorf("public key is not registered for %s", authid)
+	}
+
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"challenge":       hex.EncodeToString(challenge),
+		"channel_binding": nil,
+		"pubkey":          pubkey,
+	}, nil
+}
+
+func (a *cryptosignAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	pubkey, _ := challenge["pubkey"].(string)
+	principal, err := a.keys.GetPrincipal(pubkey)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(pubkey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key: %s", pubkey)
+	}
+	str, _ := challenge["challenge"].(string)
+	message, err := hex.DecodeString(str)
+	if err != nil {
+		return nil, fmt.Errorf("invalid challenge: %v", err)
+	}
+
+	// the signature is followed by the message it signs
+	sig, err := hex.DecodeString(signature)
+	if err != nil || len(sig) < ed25519.SignatureSize {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	if signed := sig[ed25519.SignatureSize:]; len(signed) > 0 && !bytes.Equal(signed, message) {
+		return nil, fmt.Errorf("signature is for a different challenge")
+	}
+	if !ed25519.Verify(ed25519.PublicKey(key), message, sig[:ed25519.SignatureSize]) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return map[string]interface{}{
+		"authid":       principal.AuthId,
+		"authrole":     principal.AuthRole,
+		"authprovider": "static",
+	}, nil
+}
+
+// CryptosignAuthFunc returns an AuthFunc that signs cryptosign challenges with
+// the private key.
+//
+// The client must also provide its public key in the HELLO details, which
+// CryptosignAuthExtra returns.
+func CryptosignAuthFunc(key ed25519.PrivateKey) AuthFunc {
+	return func(hello map[string]interface{}, extra map[string]interface{}) (string, map[string]interface{}, error) {
+		challenge, ok := extra["challenge"].(string)
+		if !ok {
+			return "", nil, fmt.Errorf("no challenge data received")
+		}
+		message, err := hex.DecodeString(challenge)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid challenge: %v", err)
+		}
+		sig := ed25519.Sign(key, message)
+		return hex.EncodeToString(append(sig, message...)), make(map[string]interface{}), nil
+	}
+}
+
+// CryptosignAuthExtra returns the authextra HELLO details that identify a
+// client by its public key.
+func CryptosignAuthExtra(key ed25519.PrivateKey) map[string]interface{} {
+	pubkey := key.Public().(ed25519.PublicKey)
+	return map[string]interface{}{"pubkey": hex.EncodeToString(pubkey)}
+}
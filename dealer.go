@@ -1,6 +1,11 @@
 package turnpike
 
-import "sync"
+import (
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
 
 // A Dealer routes and manages RPC calls to callees.
 type Dealer interface {
@@ -14,60 +19,275 @@ type Dealer interface {
 	Yield(*Session, *Yield)
 	// Handle an ERROR message from an invocation
 	Error(*Session, *Error)
-	// Remove a callee's registrations
+	// Cancel a procedure call
+	Cancel(*Session, *Cancel)
+	// Remove a session's registrations and clean up its calls in progress
 	RemoveSession(*Session)
 }
 
+// Invocation policies for shared registrations.
+const (
+	// Only a single callee may register the procedure. This is the default policy.
+	InvokeSingle = "single"
+	// Invoke each callee in turn.
+	InvokeRoundRobin = "roundrobin"
+	// Invoke a randomly selected callee.
+	InvokeRandom = "random"
+	// Invoke the callee that registered the procedure first.
+	InvokeFirst = "first"
+	// Invoke the callee that registered the procedure last.
+	InvokeLast = "last"
+)
+
+// invokePolicy returns the invocation policy requested in a REGISTER options
+// map, and false if the policy is not supported.
+func invokePolicy(options map[string]interface{}) (string, bool) {
+	invoke, ok := options["invoke"]
+	if !ok {
+		return InvokeSingle, true
+	}
+	switch invoke, _ := invoke.(string); invoke {
+	case InvokeSingle, InvokeRoundRobin, InvokeRandom, InvokeFirst, InvokeLast:
+		return invoke, true
+	}
+	return "", false
+}
+
 type remoteProcedure struct {
-	Endpoint  *Session
 	Procedure URI
+	Match     string
+	Invoke    string
+	Created   time.Time
+	// maximum duration of calls to the procedure, 0 for no limit
+	Timeout time.Duration
+	// callees in the order they registered the procedure
+	Endpoints []*Session
+	// index of the next endpoint to use for round-robin invocations
+	next int
+}
+
+// endpoint selects the callee for the next invocation according to the
+// invocation policy.
+func (p *remoteProcedure) endpoint() *Session {
+	switch p.Invoke {
+	case InvokeRoundRobin:
+		if p.next >= len(p.Endpoints) {
+			p.next = 0
+		}
+		e := p.Endpoints[p.next]
+		p.next++
+		return e
+	case InvokeRandom:
+		return p.Endpoints[rand.Intn(len(p.Endpoints))]
+	case InvokeLast:
+		return p.Endpoints[len(p.Endpoints)-1]
+	default:
+		return p.Endpoints[0]
+	}
+}
+
+func (p *remoteProcedure) hasEndpoint(callee *Session) bool {
+	for _, e := range p.Endpoints {
+		if e == callee {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *remoteProcedure) removeEndpoint(callee *Session) {
+	for i, e := range p.Endpoints {
+		if e == callee {
+			p.Endpoints = append(p.Endpoints[:i], p.Endpoints[i+1:]...)
+			// keep the round-robin position on the callee that was next
+			if i < p.next {
+				p.next--
+			}
+			return
+		}
+	}
+}
+
+// Cancel modes for CANCEL messages.
+const (
+	// Return an error to the caller without interrupting the callee.
+	CancelSkip = "skip"
+	// Interrupt the callee and return an error to the caller once the callee
+	// has responded.
+	CancelKill = "kill"
+	// Interrupt the callee and return an error to the caller immediately. This
+	// is the default mode.
+	CancelKillNoWait = "killnowait"
+)
+
+// identifies a CALL, as request IDs are only unique within the caller's session
+type callKey struct {
+	caller  *Session
+	request ID
+}
+
+// an invocation that is waiting for a YIELD or ERROR from the callee
+type invocation struct {
+	callID ID
+	caller *Session
+	callee *Session
+	// set when the caller wants to receive progressive results
+	receiveProgress bool
+	// set when the call was canceled in "kill" mode and the caller is waiting
+	// for the callee to respond
+	canceled bool
+	// cancels the call when it times out
+	timer *time.Timer
 }
 
 type defaultDealer struct {
 	// map registration IDs to procedures
-	procedures map[ID]remoteProcedure
-	// map procedure URIs to registration IDs
-	// TODO: this will eventually need to be `map[URI][]ID` to support
-	// multiple callees for the same procedure
-	registrations map[URI]ID
-	// keep track of call IDs so we can send the response to the caller
-	calls map[ID]*Session
-	// link the invocation ID to the call ID
-	invocations map[ID]ID
+	procedures map[ID]*remoteProcedure
+	// map procedure URIs to registration IDs, one map for each match policy
+	registrations         map[URI]ID
+	prefixRegistrations   map[URI]ID
+	wildcardRegistrations map[URI]ID
+	// link the caller's call to the invocation ID
+	calls map[callKey]ID
+	// keep track of invocations so we can send the response to the caller
+	invocations map[ID]*invocation
 	// keep track of callee's registrations
 	callees map[*Session]map[ID]bool
 	// protect maps from concurrent access
 	lock sync.Mutex
+	// publishes registration meta events, set by the realm
+	publish func(*Publish)
 }
 
 // NewDefaultDealer returns the default turnpike dealer implementation
 func NewDefaultDealer() Dealer {
 	return &defaultDealer{
-		procedures:    make(map[ID]remoteProcedure),
-		registrations: make(map[URI]ID),
-		calls:         make(map[ID]*Session),
-		invocations:   make(map[ID]ID),
-		callees:       make(map[*Session]map[ID]bool),
+		procedures:            make(map[ID]*remoteProcedure),
+		registrations:         make(map[URI]ID),
+		prefixRegistrations:   make(map[URI]ID),
+		wildcardRegistrations: make(map[URI]ID),
+		calls:                 make(map[callKey]ID),
+		invocations:           make(map[ID]*invocation),
+		callees:               make(map[*Session]map[ID]bool),
+	}
+}
+
+// registrationsFor returns the registrations for the given match policy.
+func (d *defaultDealer) registrationsFor(match string) map[URI]ID {
+	switch match {
+	case MatchPrefix:
+		return d.prefixRegistrations
+	case MatchWildcard:
+		return d.wildcardRegistrations
+	default:
+		return d.registrations
 	}
 }
 
+// match returns the ID of the registration that should handle a call to the
+// procedure.
+//
+// An exact registration takes precedence over a prefix registration, which
+// takes precedence over a wildcard registration. If several prefix
+// registrations match, the longest prefix wins. If several wildcard
+// registrations match, the one with a literal component in the leftmost
+// position where the others have a wildcard wins.
+//
+// The caller must hold the lock.
+func (d *defaultDealer) match(procedure URI) (ID, bool) {
+	if reg, ok := d.registrations[procedure]; ok {
+		return reg, true
+	}
+
+	var (
+		best  URI
+		reg   ID
+		found bool
+	)
+	for prefix, id := range d.prefixRegistrations {
+		if matchURI(MatchPrefix, prefix, procedure) && (!found || len(prefix) > len(best)) {
+			best, reg, found = prefix, id, true
+		}
+	}
+	if found {
+		return reg, true
+	}
+
+	for pattern, id := range d.wildcardRegistrations {
+		if matchURI(MatchWildcard, pattern, procedure) && (!found || moreSpecific(pattern, best)) {
+			best, reg, found = pattern, id, true
+		}
+	}
+	return reg, found
+}
+
+// moreSpecific reports whether wildcard pattern a takes precedence over b.
+func moreSpecific(a, b URI) bool {
+	ac := strings.Split(string(a), ".")
+	bc := strings.Split(string(b), ".")
+	for i := 0; i < len(ac) && i < len(bc); i++ {
+		if (ac[i] == "") != (bc[i] == "") {
+			return ac[i] != ""
+		}
+	}
+	return a < b
+}
+
+// Register registers the callee for the procedure.
+//
+// msg.Options["invoke"] may be "single" (the default), "roundrobin", "random",
+// "first" or "last". A procedure can be registered by multiple callees as long
+// as they all use the same policy, and the policy is not "single".
+//
+// msg.Options["match"] may be "exact" (the default), "prefix" or "wildcard".
+//
+// msg.Options["timeout"] sets the maximum duration of calls to the procedure
+// in milliseconds.
 func (d *defaultDealer) Register(callee *Session, msg *Register) {
-	reg := NewID()
-	d.lock.Lock()
-	if id, ok := d.registrations[msg.Procedure]; ok {
-		d.lock.Unlock()
-		log.Println("error: procedure already exists:", msg.Procedure, id)
+	invoke, validInvoke := invokePolicy(msg.Options)
+	match, validMatch := matchPolicy(msg.Options)
+	if !validInvoke || !validMatch {
+		log.Println("error: invalid registration options:", msg.Options)
 		callee.Send(&Error{
 			Type:    msg.MessageType(),
 			Request: msg.Request,
 			Details: make(map[string]interface{}),
-			Error:   ErrProcedureAlreadyExists,
+			Error:   ErrInvalidArgument,
 		})
 		return
 	}
-	d.procedures[reg] = remoteProcedure{callee, msg.Procedure}
-	d.registrations[msg.Procedure] = reg
+
+	d.lock.Lock()
+	registrations := d.registrationsFor(match)
+	reg, ok := registrations[msg.Procedure]
+	if ok {
+		proc := d.procedures[reg]
+		if invoke == InvokeSingle || proc.Invoke != invoke || proc.hasEndpoint(callee) {
+			d.lock.Unlock()
+			log.Println("error: procedure already exists:", msg.Procedure, reg)
+			callee.Send(&Error{
+				Type:    msg.MessageType(),
+				Request: msg.Request,
+				Details: make(map[string]interface{}),
+				Error:   ErrProcedureAlreadyExists,
+			})
+			return
+		}
+		proc.Endpoints = append(proc.Endpoints, callee)
+	} else {
+		reg = NewID()
+		d.procedures[reg] = &remoteProcedure{
+			Procedure: msg.Procedure,
+			Match:     match,
+			Invoke:    invoke,
+			Created:   time.Now(),
+			Timeout:   timeoutOption(msg.Options),
+			Endpoints: []*Session{callee},
+		}
+		registrations[msg.Procedure] = reg
+	}
 	d.addCalleeRegistration(callee, reg)
+	details := d.details(reg)
 	d.lock.Unlock()
 
 	log.Printf("registered procedure %v [%v]", reg, msg.Procedure)
@@ -75,11 +295,20 @@ func (d *defaultDealer) Register(callee *Session, msg *Register) {
 		Request:      msg.Request,
 		Registration: reg,
 	})
+
+	// registrations of the meta API don't generate meta events
+	if isMetaURI(msg.Procedure) {
+		return
+	}
+	if !ok {
+		d.publishMeta("wamp.registration.on_create", callee.Id, details)
+	}
+	d.publishMeta("wamp.registration.on_register", callee.Id, reg)
 }
 
 func (d *defaultDealer) Unregister(callee *Session, msg *Unregister) {
 	d.lock.Lock()
-	if procedure, ok := d.procedures[msg.Registration]; !ok {
+	if procedure, ok := d.procedures[msg.Registration]; !ok || !d.callees[callee][msg.Registration] {
 		d.lock.Unlock()
 		// the registration doesn't exist
 		log.Println("error: no such registration:", msg.Registration)
@@ -90,20 +319,37 @@ func (d *defaultDealer) Unregister(callee *Session, msg *Unregister) {
 			Error:   ErrNoSuchRegistration,
 		})
 	} else {
-		delete(d.registrations, procedure.Procedure)
-		delete(d.procedures, msg.Registration)
-		d.removeCalleeRegistration(callee, msg.Registration)
+		deleted := d.removeEndpoint(callee, msg.Registration)
 		d.lock.Unlock()
 		log.Printf("unregistered procedure %v [%v]", procedure.Procedure, msg.Registration)
 		callee.Send(&Unregistered{
 			Request: msg.Request,
 		})
+
+		if isMetaURI(procedure.Procedure) {
+			return
+		}
+		d.publishMeta("wamp.registration.on_unregister", callee.Id, msg.Registration)
+		if deleted {
+			d.publishMeta("wamp.registration.on_delete", callee.Id, msg.Registration)
+		}
 	}
 }
 
+// Call invokes the procedure on a callee.
+//
+// If the call was routed through a prefix or wildcard registration, the callee
+// receives the procedure that was called in Details["procedure"].
+//
+// If msg.Options["receive_progress"] == true, the callee receives
+// Details["receive_progress"] and may send progressive results.
+//
+// If msg.Options["timeout"] is set, or the registration has a timeout, the
+// call is canceled in "killnowait" mode once the shorter of the two timeouts
+// (in milliseconds) expires.
 func (d *defaultDealer) Call(caller *Session, msg *Call) {
 	d.lock.Lock()
-	if reg, ok := d.registrations[msg.Procedure]; !ok {
+	if reg, ok := d.match(msg.Procedure); !ok {
 		d.lock.Unlock()
 		caller.Send(&Error{
 			Type:    msg.MessageType(),
@@ -124,21 +370,46 @@ func (d *defaultDealer) Call(caller *Session, msg *Call) {
 			})
 		} else {
 			// everything checks out, make the invocation request
-			d.calls[msg.Request] = caller
 			invocationID := NewID()
-			d.invocations[invocationID] = msg.Request
+			callee := rproc.endpoint()
+			receiveProgress, _ := msg.Options["receive_progress"].(bool)
+			inv := &invocation{
+				callID:          msg.Request,
+				caller:          caller,
+				callee:          callee,
+				receiveProgress: receiveProgress,
+			}
+			if timeout := minTimeout(timeoutOption(msg.Options), rproc.Timeout); timeout > 0 {
+				inv.timer = time.AfterFunc(timeout, func() {
+					d.timeout(invocationID)
+				})
+			}
+			d.calls[callKey{caller, msg.Request}] = invocationID
+			d.invocations[invocationID] = inv
 			d.lock.Unlock()
-			details := map[string]interface{}{};
+			details := map[string]interface{}{}
+			if receiveProgress {
+				details["receive_progress"] = true
+			}
 
 			// Options{"disclose_me": true} -> Details{"caller": 3335656}
 			if val, ok := msg.Options["disclose_me"]; ok {
 				if disclose, ok := val.(bool); ok && (disclose == true) {
 					details["caller"] = caller.Id
+					if caller.AuthId != "" {
+						details["caller_authid"] = caller.AuthId
+					}
+					if caller.AuthRole != "" {
+						details["caller_authrole"] = caller.AuthRole
+					}
 				}
 			}
+			if rproc.Match != MatchExact {
+				details["procedure"] = msg.Procedure
+			}
 
 			// TODO deal with Details{"trustlevel": 2}
-			rproc.Endpoint.Send(&Invocation{
+			callee.Send(&Invocation{
 				Request:      invocationID,
 				Registration: reg,
 				Details:      details,
@@ -152,71 +423,291 @@ func (d *defaultDealer) Call(caller *Session, msg *Call) {
 	}
 }
 
+// Yield returns the result of an invocation to the caller.
+//
+// If msg.Options["progress"] == true and the caller asked to receive
+// progressive results, the result is sent with Details["progress"] and the
+// call stays active until the final YIELD.
 func (d *defaultDealer) Yield(callee *Session, msg *Yield) {
+	progress, _ := msg.Options["progress"].(bool)
 	d.lock.Lock()
-	if callID, ok := d.invocations[msg.Request]; !ok {
+	if inv, ok := d.invocations[msg.Request]; !ok || inv.callee != callee {
 		d.lock.Unlock()
 		// WAMP spec doesn't allow sending an error in response to a YIELD message
 		log.Println("received YIELD message with invalid invocation request ID:", msg.Request)
+	} else if progress {
+		discard := !inv.receiveProgress || inv.canceled
+		d.lock.Unlock()
+		if discard {
+			log.Printf("discarding progressive YIELD %v for CALL %v", msg.Request, inv.callID)
+			return
+		}
+		inv.caller.Send(&Result{
+			Request:     inv.callID,
+			Details:     map[string]interface{}{"progress": true},
+			Arguments:   msg.Arguments,
+			ArgumentsKw: msg.ArgumentsKw,
+		})
+		log.Printf("returned progressive YIELD %v to caller as RESULT %v", msg.Request, inv.callID)
 	} else {
-		delete(d.invocations, msg.Request)
-		if caller, ok := d.calls[callID]; !ok {
-			// found the invocation id, but doesn't match any call id
-			// WAMP spec doesn't allow sending an error in response to a YIELD message
-			d.lock.Unlock()
-			log.Printf("received YIELD message, but unable to match it (%v) to a CALL ID", msg.Request)
-		} else {
-			delete(d.calls, callID)
-			d.lock.Unlock()
-			// return the result to the caller
-			caller.Send(&Result{
-				Request:     callID,
-				Details:     map[string]interface{}{},
-				Arguments:   msg.Arguments,
-				ArgumentsKw: msg.ArgumentsKw,
-			})
-			log.Printf("returned YIELD %v to caller as RESULT %v", msg.Request, callID)
+		d.removeInvocation(msg.Request, inv)
+		d.lock.Unlock()
+		if inv.canceled {
+			inv.caller.Send(canceledError(inv.callID))
+			log.Printf("received YIELD %v for canceled CALL %v", msg.Request, inv.callID)
+			return
 		}
+		// return the result to the caller
+		inv.caller.Send(&Result{
+			Request:     inv.callID,
+			Details:     map[string]interface{}{},
+			Arguments:   msg.Arguments,
+			ArgumentsKw: msg.ArgumentsKw,
+		})
+		log.Printf("returned YIELD %v to caller as RESULT %v", msg.Request, inv.callID)
 	}
 }
 
 func (d *defaultDealer) Error(peer *Session, msg *Error) {
 	d.lock.Lock()
-	if callID, ok := d.invocations[msg.Request]; !ok {
+	if inv, ok := d.invocations[msg.Request]; !ok || inv.callee != peer {
 		d.lock.Unlock()
 		log.Println("received ERROR (INVOCATION) message with invalid invocation request ID:", msg.Request)
 	} else {
-		delete(d.invocations, msg.Request)
-		if caller, ok := d.calls[callID]; !ok {
-			d.lock.Unlock()
-			log.Printf("received ERROR (INVOCATION) message, but unable to match it (%v) to a CALL ID", msg.Request)
-		} else {
-			delete(d.calls, callID)
-			d.lock.Unlock()
-			// return an error to the caller
-			caller.Send(&Error{
-				Type:        CALL,
-				Request:     callID,
-				Error:       msg.Error,
-				Details:     make(map[string]interface{}),
-				Arguments:   msg.Arguments,
-				ArgumentsKw: msg.ArgumentsKw,
-			})
-			log.Printf("returned ERROR %v to caller as ERROR %v", msg.Request, callID)
+		d.removeInvocation(msg.Request, inv)
+		d.lock.Unlock()
+		if inv.canceled {
+			inv.caller.Send(canceledError(inv.callID))
+			log.Printf("received ERROR %v for canceled CALL %v", msg.Request, inv.callID)
+			return
 		}
+		// return an error to the caller
+		inv.caller.Send(&Error{
+			Type:        CALL,
+			Request:     inv.callID,
+			Error:       msg.Error,
+			Details:     make(map[string]interface{}),
+			Arguments:   msg.Arguments,
+			ArgumentsKw: msg.ArgumentsKw,
+		})
+		log.Printf("returned ERROR %v to caller as ERROR %v", msg.Request, inv.callID)
+	}
+}
+
+// Cancel cancels a call that is in progress.
+//
+// msg.Options["mode"] may be "skip", "kill" or "killnowait" (the default). In
+// "kill" and "killnowait" mode, the callee is sent an INTERRUPT message. The
+// caller receives a wamp.error.canceled error, which in "kill" mode is sent
+// once the callee has responded to the interrupt.
+func (d *defaultDealer) Cancel(caller *Session, msg *Cancel) {
+	mode := CancelKillNoWait
+	if m, ok := msg.Options["mode"]; ok {
+		mode, _ = m.(string)
+	}
+	switch mode {
+	case CancelSkip, CancelKill, CancelKillNoWait:
+	default:
+		log.Println("error: invalid cancel mode:", msg.Options["mode"])
+		caller.Send(&Error{
+			Type:    msg.MessageType(),
+			Request: msg.Request,
+			Details: make(map[string]interface{}),
+			Error:   ErrInvalidArgument,
+		})
+		return
+	}
+
+	d.lock.Lock()
+	invocationID, ok := d.calls[callKey{caller, msg.Request}]
+	inv := d.invocations[invocationID]
+	if !ok || inv.canceled {
+		d.lock.Unlock()
+		// the call has already returned, or is already being canceled
+		log.Println("received CANCEL message with invalid call request ID:", msg.Request)
+		return
+	}
+	if mode == CancelKill {
+		inv.canceled = true
+	} else {
+		d.removeInvocation(invocationID, inv)
+	}
+	d.lock.Unlock()
+
+	if mode != CancelSkip {
+		inv.callee.Send(&Interrupt{
+			Request: invocationID,
+			Options: map[string]interface{}{"mode": mode},
+		})
+	}
+	if mode != CancelKill {
+		caller.Send(canceledError(msg.Request))
 	}
+	log.Printf("canceled CALL %v (INVOCATION %v) with mode %s", msg.Request, invocationID, mode)
 }
 
-func (d *defaultDealer) RemoveSession(callee *Session) {
+// timeout cancels an invocation that has taken too long.
+func (d *defaultDealer) timeout(invocationID ID) {
 	d.lock.Lock()
-	defer d.lock.Unlock()
-	for reg := range d.callees[callee] {
-		if procedure, ok := d.procedures[reg]; ok {
-			delete(d.registrations, procedure.Procedure)
+	inv, ok := d.invocations[invocationID]
+	if !ok {
+		d.lock.Unlock()
+		return
+	}
+	d.removeInvocation(invocationID, inv)
+	d.lock.Unlock()
+
+	inv.callee.Send(&Interrupt{
+		Request: invocationID,
+		Options: map[string]interface{}{"mode": CancelKillNoWait},
+	})
+	inv.caller.Send(canceledError(inv.callID))
+	log.Printf("CALL %v (INVOCATION %v) timed out", inv.callID, invocationID)
+}
+
+// removeInvocation forgets an invocation that has completed or was canceled.
+//
+// The caller must hold the lock.
+func (d *defaultDealer) removeInvocation(invocationID ID, inv *invocation) {
+	delete(d.invocations, invocationID)
+	delete(d.calls, callKey{inv.caller, inv.callID})
+	if inv.timer != nil {
+		inv.timer.Stop()
+	}
+}
+
+// timeoutOption returns the "timeout" option in milliseconds as a duration.
+func timeoutOption(options map[string]interface{}) time.Duration {
+	if ms, ok := toInt64(options["timeout"]); ok && ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return 0
+}
+
+// minTimeout returns the shorter of two timeouts, where 0 means no timeout.
+func minTimeout(a, b time.Duration) time.Duration {
+	if a == 0 || (b != 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func canceledError(callID ID) *Error {
+	return &Error{
+		Type:    CALL,
+		Request: callID,
+		Details: make(map[string]interface{}),
+		Error:   ErrCanceled,
+	}
+}
+
+// RemoveSession removes the session's registrations, and cleans up the calls
+// it was involved in.
+//
+// Callers waiting on the session as a callee receive a wamp.error.callee_lost
+// error, and callees working on calls made by the session are interrupted.
+func (d *defaultDealer) RemoveSession(sess *Session) {
+	d.lock.Lock()
+	var removed, deleted []ID
+	for reg := range d.callees[sess] {
+		proc, ok := d.procedures[reg]
+		publish := ok && !isMetaURI(proc.Procedure)
+		if d.removeEndpoint(sess, reg) && publish {
+			deleted = append(deleted, reg)
+		}
+		if publish {
+			removed = append(removed, reg)
+		}
+	}
+	lost, orphaned := make(map[ID]*invocation), make(map[ID]*invocation)
+	for id, inv := range d.invocations {
+		if inv.callee == sess {
+			lost[id] = inv
+		} else if inv.caller == sess {
+			orphaned[id] = inv
+		} else {
+			continue
+		}
+		d.removeInvocation(id, inv)
+	}
+	d.lock.Unlock()
+
+	for id, inv := range lost {
+		if inv.caller == sess {
+			continue
+		}
+		inv.caller.Send(&Error{
+			Type:    CALL,
+			Request: inv.callID,
+			Details: make(map[string]interface{}),
+			Error:   ErrCalleeLost,
+		})
+		log.Printf("callee of INVOCATION %v left, returned error to CALL %v", id, inv.callID)
+	}
+	for id, inv := range orphaned {
+		inv.callee.Send(&Interrupt{
+			Request: id,
+			Options: map[string]interface{}{"mode": CancelKillNoWait},
+		})
+		log.Printf("caller of CALL %v left, interrupted INVOCATION %v", inv.callID, id)
+	}
+
+	for _, reg := range removed {
+		d.publishMeta("wamp.registration.on_unregister", sess.Id, reg)
+	}
+	for _, reg := range deleted {
+		d.publishMeta("wamp.registration.on_delete", sess.Id, reg)
+	}
+}
+
+// removeEndpoint removes the callee from the registration, and removes the
+// registration if it has no callees left. It reports whether the registration
+// was removed.
+//
+// The caller must hold the lock.
+func (d *defaultDealer) removeEndpoint(callee *Session, reg ID) bool {
+	deleted := false
+	if procedure, ok := d.procedures[reg]; ok {
+		procedure.removeEndpoint(callee)
+		if len(procedure.Endpoints) == 0 {
+			delete(d.registrationsFor(procedure.Match), procedure.Procedure)
 			delete(d.procedures, reg)
+			deleted = true
 		}
-		d.removeCalleeRegistration(callee, reg)
 	}
+	d.removeCalleeRegistration(callee, reg)
+	return deleted
+}
+
+// details returns the details of a registration, as sent in meta events and
+// returned by wamp.registration.get.
+//
+// The caller must hold the lock.
+func (d *defaultDealer) details(reg ID) map[string]interface{} {
+	proc := d.procedures[reg]
+	return map[string]interface{}{
+		"id":      reg,
+		"created": proc.Created.UTC().Format(time.RFC3339Nano),
+		"uri":     proc.Procedure,
+		"match":   proc.Match,
+		"invoke":  proc.Invoke,
+	}
+}
+
+// publishMeta publishes a registration meta event, if the dealer is attached
+// to a realm.
+//
+// The caller must not hold the lock.
+func (d *defaultDealer) publishMeta(topic URI, args ...interface{}) {
+	if d.publish == nil {
+		return
+	}
+	d.publish(&Publish{
+		Request:   NewID(),
+		Options:   make(map[string]interface{}),
+		Topic:     topic,
+		Arguments: args,
+	})
 }
 
 func (d *defaultDealer) addCalleeRegistration(callee *Session, reg ID) {
@@ -2,6 +2,7 @@ package turnpike
 
 import (
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -146,3 +147,367 @@ func TestRemovePeer(t *testing.T) {
 		})
 	})
 }
+
+func TestSharedRegistration(t *testing.T) {
+	Convey("Given a procedure registered with the roundrobin policy", t, func() {
+		dealer := NewDefaultDealer().(*defaultDealer)
+		testProcedure := URI("turnpike.test.endpoint")
+		options := map[string]interface{}{"invoke": "roundrobin"}
+		callee1, callee2 := &TestPeer{}, &TestPeer{}
+		sess1, sess2 := &Session{Peer: callee1}, &Session{Peer: callee2}
+		dealer.Register(sess1, &Register{Request: 123, Options: options, Procedure: testProcedure})
+		reg := callee1.received.(*Registered).Registration
+
+		Convey("A second callee using the same policy should join the registration", func() {
+			dealer.Register(sess2, &Register{Request: 456, Options: options, Procedure: testProcedure})
+			So(callee2.received.(*Registered).Registration, ShouldEqual, reg)
+			So(dealer.procedures[reg].Endpoints, ShouldHaveLength, 2)
+
+			Convey("Calls should alternate between the callees", func() {
+				caller := &Session{Peer: &TestPeer{}}
+				dealer.Call(caller, &Call{Request: 1, Procedure: testProcedure})
+				So(callee1.received.MessageType(), ShouldEqual, INVOCATION)
+				dealer.Call(caller, &Call{Request: 2, Procedure: testProcedure})
+				So(callee2.received.MessageType(), ShouldEqual, INVOCATION)
+				first := callee1.received.(*Invocation).Request
+				dealer.Call(caller, &Call{Request: 3, Procedure: testProcedure})
+				So(callee1.received.(*Invocation).Request, ShouldNotEqual, first)
+			})
+
+			Convey("Removing a callee should not skip the callee after it", func() {
+				callee3 := &TestPeer{}
+				dealer.Register(&Session{Peer: callee3}, &Register{Request: 789, Options: options, Procedure: testProcedure})
+				caller := &Session{Peer: &TestPeer{}}
+				dealer.Call(caller, &Call{Request: 1, Procedure: testProcedure})
+				So(callee1.received.MessageType(), ShouldEqual, INVOCATION)
+				dealer.Unregister(sess1, &Unregister{Request: 124, Registration: reg})
+				dealer.Call(caller, &Call{Request: 2, Procedure: testProcedure})
+				So(callee2.received.MessageType(), ShouldEqual, INVOCATION)
+				So(callee3.received.MessageType(), ShouldEqual, REGISTERED)
+			})
+
+			Convey("The registration should remain until the last callee unregisters", func() {
+				dealer.Unregister(sess1, &Unregister{Request: 124, Registration: reg})
+				So(callee1.received.MessageType(), ShouldEqual, UNREGISTERED)
+				So(dealer.registrations, ShouldContainKey, testProcedure)
+				So(dealer.procedures[reg].Endpoints, ShouldResemble, []*Session{sess2})
+
+				dealer.RemoveSession(sess2)
+				So(dealer.registrations, ShouldNotContainKey, testProcedure)
+				So(dealer.procedures, ShouldNotContainKey, reg)
+			})
+		})
+
+		Convey("A callee using a different policy should not be able to register", func() {
+			dealer.Register(sess2, &Register{
+				Request:   456,
+				Options:   map[string]interface{}{"invoke": "random"},
+				Procedure: testProcedure,
+			})
+			So(callee2.received.(*Error).Error, ShouldEqual, ErrProcedureAlreadyExists)
+		})
+
+		Convey("A callee that isn't registered should not be able to unregister", func() {
+			dealer.Unregister(sess2, &Unregister{Request: 456, Registration: reg})
+			So(callee2.received.(*Error).Error, ShouldEqual, ErrNoSuchRegistration)
+			So(dealer.procedures[reg].Endpoints, ShouldHaveLength, 1)
+		})
+
+		Convey("Registering with an unknown policy should fail", func() {
+			dealer.Register(sess2, &Register{
+				Request:   456,
+				Options:   map[string]interface{}{"invoke": "broadcast"},
+				Procedure: URI("turnpike.test.other"),
+			})
+			So(callee2.received.(*Error).Error, ShouldEqual, ErrInvalidArgument)
+		})
+	})
+
+	Convey("Given a procedure registered with the last policy", t, func() {
+		dealer := NewDefaultDealer().(*defaultDealer)
+		testProcedure := URI("turnpike.test.endpoint")
+		options := map[string]interface{}{"invoke": "last"}
+		callee1, callee2 := &TestPeer{}, &TestPeer{}
+		dealer.Register(&Session{Peer: callee1}, &Register{Request: 123, Options: options, Procedure: testProcedure})
+		dealer.Register(&Session{Peer: callee2}, &Register{Request: 456, Options: options, Procedure: testProcedure})
+
+		Convey("Calls should go to the most recently registered callee", func() {
+			dealer.Call(&Session{Peer: &TestPeer{}}, &Call{Request: 1, Procedure: testProcedure})
+			So(callee1.received.MessageType(), ShouldEqual, REGISTERED)
+			So(callee2.received.MessageType(), ShouldEqual, INVOCATION)
+		})
+	})
+}
+
+func TestPatternRegistration(t *testing.T) {
+	Convey("Given exact, prefix and wildcard registrations", t, func() {
+		dealer := NewDefaultDealer().(*defaultDealer)
+		register := func(procedure URI, match string) *TestPeer {
+			callee := &TestPeer{}
+			dealer.Register(&Session{Peer: callee}, &Register{
+				Request:   NewID(),
+				Options:   map[string]interface{}{"match": match},
+				Procedure: procedure,
+			})
+			So(callee.received.MessageType(), ShouldEqual, REGISTERED)
+			return callee
+		}
+		exact := register("com.acme.legacy.status", "exact")
+		prefix := register("com.acme.legacy", "prefix")
+		longPrefix := register("com.acme.legacy.reports", "prefix")
+		wildcard := register("com.acme..get", "wildcard")
+		specificWildcard := register("com.acme.users.", "wildcard")
+		caller := &Session{Peer: &TestPeer{}}
+
+		Convey("An exact registration should take precedence", func() {
+			dealer.Call(caller, &Call{Request: 1, Procedure: "com.acme.legacy.status"})
+			So(exact.received.MessageType(), ShouldEqual, INVOCATION)
+			So(exact.received.(*Invocation).Details, ShouldNotContainKey, "procedure")
+			So(prefix.received.MessageType(), ShouldEqual, REGISTERED)
+		})
+
+		Convey("The longest matching prefix should win", func() {
+			dealer.Call(caller, &Call{Request: 1, Procedure: "com.acme.legacy.reports.daily"})
+			So(longPrefix.received.MessageType(), ShouldEqual, INVOCATION)
+			So(prefix.received.MessageType(), ShouldEqual, REGISTERED)
+
+			Convey("And the callee should receive the concrete procedure", func() {
+				details := longPrefix.received.(*Invocation).Details
+				So(details["procedure"], ShouldEqual, URI("com.acme.legacy.reports.daily"))
+			})
+		})
+
+		Convey("A prefix registration should take precedence over a wildcard", func() {
+			dealer.Call(caller, &Call{Request: 1, Procedure: "com.acme.legacy.get"})
+			So(prefix.received.MessageType(), ShouldEqual, INVOCATION)
+			So(wildcard.received.MessageType(), ShouldEqual, REGISTERED)
+		})
+
+		Convey("The wildcard with the leftmost literal component should win", func() {
+			dealer.Call(caller, &Call{Request: 1, Procedure: "com.acme.users.get"})
+			So(specificWildcard.received.MessageType(), ShouldEqual, INVOCATION)
+			So(wildcard.received.MessageType(), ShouldEqual, REGISTERED)
+
+			dealer.Call(caller, &Call{Request: 2, Procedure: "com.acme.devices.get"})
+			So(wildcard.received.MessageType(), ShouldEqual, INVOCATION)
+		})
+	})
+}
+
+func TestCancel(t *testing.T) {
+	Convey("Given a call in progress", t, func() {
+		dealer := NewDefaultDealer().(*defaultDealer)
+		callee := &TestPeer{}
+		testProcedure := URI("turnpike.test.endpoint")
+		calleeSession := &Session{Peer: callee}
+		dealer.Register(calleeSession, &Register{Request: 123, Procedure: testProcedure})
+		caller := &TestPeer{}
+		callerSession := &Session{Peer: caller}
+		dealer.Call(callerSession, &Call{Request: 125, Procedure: testProcedure})
+		inv := callee.received.(*Invocation)
+
+		Convey("Canceling with skip mode", func() {
+			dealer.Cancel(callerSession, &Cancel{Request: 125, Options: map[string]interface{}{"mode": "skip"}})
+
+			Convey("The caller should receive a canceled error and the callee nothing", func() {
+				So(caller.received.(*Error).Error, ShouldEqual, ErrCanceled)
+				So(caller.received.(*Error).Request, ShouldEqual, 125)
+				So(callee.received, ShouldEqual, inv)
+				So(dealer.invocations, ShouldBeEmpty)
+				So(dealer.calls, ShouldBeEmpty)
+			})
+		})
+
+		Convey("Canceling with killnowait mode", func() {
+			dealer.Cancel(callerSession, &Cancel{Request: 125, Options: map[string]interface{}{}})
+
+			Convey("The callee should be interrupted and the caller should receive a canceled error", func() {
+				interrupt := callee.received.(*Interrupt)
+				So(interrupt.Request, ShouldEqual, inv.Request)
+				So(interrupt.Options["mode"], ShouldEqual, "killnowait")
+				So(caller.received.(*Error).Error, ShouldEqual, ErrCanceled)
+			})
+
+			Convey("A late YIELD should not be sent to the caller", func() {
+				caller.received = nil
+				dealer.Yield(calleeSession, &Yield{Request: inv.Request})
+				So(caller.received, ShouldBeNil)
+			})
+		})
+
+		Convey("Canceling with kill mode", func() {
+			dealer.Cancel(callerSession, &Cancel{Request: 125, Options: map[string]interface{}{"mode": "kill"}})
+
+			Convey("The callee should be interrupted and the caller should wait", func() {
+				So(callee.received.(*Interrupt).Options["mode"], ShouldEqual, "kill")
+				So(caller.received, ShouldBeNil)
+
+				Convey("Until the callee responds", func() {
+					dealer.Error(calleeSession, &Error{Type: INVOCATION, Request: inv.Request, Error: ErrCanceled})
+					So(caller.received.(*Error).Error, ShouldEqual, ErrCanceled)
+					So(caller.received.(*Error).Request, ShouldEqual, 125)
+				})
+			})
+		})
+
+		Convey("Canceling another session's call should be ignored", func() {
+			dealer.Cancel(&Session{Peer: &TestPeer{}}, &Cancel{Request: 125})
+			So(callee.received, ShouldEqual, inv)
+			So(dealer.calls, ShouldContainKey, callKey{callerSession, 125})
+		})
+
+		Convey("Canceling should only affect the caller's call with that request ID", func() {
+			otherCaller := &TestPeer{}
+			otherSession := &Session{Peer: otherCaller}
+			dealer.Call(otherSession, &Call{Request: 125, Procedure: testProcedure})
+			otherInv := callee.received.(*Invocation)
+
+			dealer.Cancel(callerSession, &Cancel{Request: 125})
+			So(callee.received.(*Interrupt).Request, ShouldEqual, inv.Request)
+			So(caller.received.(*Error).Error, ShouldEqual, ErrCanceled)
+			So(otherCaller.received, ShouldBeNil)
+			So(dealer.calls, ShouldContainKey, callKey{otherSession, 125})
+
+			dealer.Cancel(otherSession, &Cancel{Request: 125})
+			So(callee.received.(*Interrupt).Request, ShouldEqual, otherInv.Request)
+			So(otherCaller.received.(*Error).Error, ShouldEqual, ErrCanceled)
+			So(dealer.calls, ShouldBeEmpty)
+		})
+
+		Convey("Canceling with an unknown mode should fail", func() {
+			dealer.Cancel(callerSession, &Cancel{Request: 125, Options: map[string]interface{}{"mode": "later"}})
+			So(caller.received.(*Error).Error, ShouldEqual, ErrInvalidArgument)
+			So(dealer.calls, ShouldContainKey, callKey{callerSession, 125})
+		})
+	})
+}
+
+func TestProgressiveYield(t *testing.T) {
+	Convey("Given a call that asks for progressive results", t, func() {
+		dealer := NewDefaultDealer().(*defaultDealer)
+		callee := &TestPeer{}
+		testProcedure := URI("turnpike.test.endpoint")
+		calleeSession := &Session{Peer: callee}
+		dealer.Register(calleeSession, &Register{Request: 123, Procedure: testProcedure})
+		caller := &TestPeer{}
+		dealer.Call(&Session{Peer: caller}, &Call{
+			Request:   125,
+			Options:   map[string]interface{}{"receive_progress": true},
+			Procedure: testProcedure,
+		})
+		inv := callee.received.(*Invocation)
+		So(inv.Details["receive_progress"], ShouldEqual, true)
+
+		Convey("A progressive YIELD should be sent to the caller and keep the call active", func() {
+			dealer.Yield(calleeSession, &Yield{Request: inv.Request, Options: map[string]interface{}{"progress": true}})
+			result := caller.received.(*Result)
+			So(result.Request, ShouldEqual, 125)
+			So(result.Details["progress"], ShouldEqual, true)
+			So(dealer.invocations, ShouldContainKey, inv.Request)
+
+			Convey("Until the final YIELD", func() {
+				dealer.Yield(calleeSession, &Yield{Request: inv.Request})
+				So(caller.received.(*Result).Details, ShouldNotContainKey, "progress")
+				So(dealer.invocations, ShouldBeEmpty)
+				So(dealer.calls, ShouldBeEmpty)
+			})
+		})
+	})
+}
+
+// chanPeer makes the messages sent to it available on a channel, for tests
+// where messages are sent from another goroutine.
+type chanPeer struct {
+	messages chan Message
+}
+
+func (s *chanPeer) Send(msg Message) error  { s.messages <- msg; return nil }
+func (s *chanPeer) Receive() <-chan Message { return nil }
+func (s *chanPeer) Close() error            { return nil }
+
+func TestCallTimeout(t *testing.T) {
+	Convey("Given a registered procedure", t, func() {
+		dealer := NewDefaultDealer().(*defaultDealer)
+		callee := &chanPeer{messages: make(chan Message, 10)}
+		calleeSession := &Session{Peer: callee}
+		testProcedure := URI("turnpike.test.endpoint")
+		dealer.Register(calleeSession, &Register{
+			Request:   123,
+			Options:   map[string]interface{}{"timeout": 5000},
+			Procedure: testProcedure,
+		})
+		So((<-callee.messages).MessageType(), ShouldEqual, REGISTERED)
+		caller := &chanPeer{messages: make(chan Message, 10)}
+		callerSession := &Session{Peer: caller}
+
+		Convey("A call with a timeout that the callee doesn't meet should be canceled", func() {
+			dealer.Call(callerSession, &Call{
+				Request:   125,
+				Options:   map[string]interface{}{"timeout": float64(10)},
+				Procedure: testProcedure,
+			})
+			inv := (<-callee.messages).(*Invocation)
+
+			select {
+			case msg := <-caller.messages:
+				So(msg.(*Error).Error, ShouldEqual, ErrCanceled)
+				So(msg.(*Error).Request, ShouldEqual, 125)
+			case <-time.After(time.Second):
+				t.Fatal("call did not time out")
+			}
+			So((<-callee.messages).(*Interrupt).Request, ShouldEqual, inv.Request)
+			dealer.lock.Lock()
+			So(dealer.invocations, ShouldBeEmpty)
+			So(dealer.calls, ShouldBeEmpty)
+			dealer.lock.Unlock()
+		})
+
+		Convey("A call that completes in time should stop the timer", func() {
+			dealer.Call(callerSession, &Call{Request: 125, Procedure: testProcedure})
+			inv := (<-callee.messages).(*Invocation)
+			timer := dealer.invocations[inv.Request].timer
+			So(timer, ShouldNotBeNil)
+			dealer.Yield(calleeSession, &Yield{Request: inv.Request})
+			So((<-caller.messages).MessageType(), ShouldEqual, RESULT)
+			So(timer.Stop(), ShouldBeFalse)
+		})
+	})
+
+	Convey("Timeouts should use the shorter non-zero duration", t, func() {
+		So(minTimeout(0, time.Second), ShouldEqual, time.Second)
+		So(minTimeout(time.Second, 0), ShouldEqual, time.Second)
+		So(minTimeout(time.Minute, time.Second), ShouldEqual, time.Second)
+		So(minTimeout(0, 0), ShouldEqual, 0)
+	})
+}
+
+func TestRemoveSessionWithCalls(t *testing.T) {
+	Convey("Given a call in progress", t, func() {
+		dealer := NewDefaultDealer().(*defaultDealer)
+		callee := &TestPeer{}
+		testProcedure := URI("turnpike.test.endpoint")
+		calleeSession := &Session{Peer: callee}
+		dealer.Register(calleeSession, &Register{Request: 123, Procedure: testProcedure})
+		caller := &TestPeer{}
+		callerSession := &Session{Peer: caller}
+		dealer.Call(callerSession, &Call{Request: 125, Procedure: testProcedure})
+		inv := callee.received.(*Invocation)
+
+		Convey("When the callee leaves, the caller should receive an error", func() {
+			dealer.RemoveSession(calleeSession)
+			err := caller.received.(*Error)
+			So(err.Request, ShouldEqual, 125)
+			So(err.Error, ShouldEqual, ErrCalleeLost)
+			So(dealer.invocations, ShouldBeEmpty)
+			So(dealer.calls, ShouldBeEmpty)
+		})
+
+		Convey("When the caller leaves, the callee should be interrupted", func() {
+			dealer.RemoveSession(callerSession)
+			So(callee.received.(*Interrupt).Request, ShouldEqual, inv.Request)
+			So(dealer.invocations, ShouldBeEmpty)
+			So(dealer.calls, ShouldBeEmpty)
+			So(dealer.registrations, ShouldContainKey, testProcedure)
+		})
+	})
+}
@@ -0,0 +1,206 @@
+package turnpike
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// localCaller is implemented by authenticators and authorizers that call
+// procedures through the local client of the realm they are used in.
+type localCaller interface {
+	setLocalClient(client *Client)
+	// localProcedure returns the procedure called through the local client.
+	localProcedure() URI
+}
+
+// dynamicCaller calls an auth procedure through a realm's local client.
+type dynamicCaller struct {
+	procedure URI
+	timeout   time.Duration
+	client    *Client
+}
+
+func (c *dynamicCaller) setLocalClient(client *Client) {
+	c.client = client
+}
+
+func (c *dynamicCaller) localProcedure() URI {
+	return c.procedure
+}
+
+// call calls the procedure with the arguments, and returns the result.
+func (c *dynamicCaller) call(args ...interface{}) (*Result, error) {
+	if c.client == nil {
+		return nil, fmt.Errorf("%s: not used in a realm", c.procedure)
+	}
+	options := make(map[string]interface{})
+	if c.timeout > 0 {
+		options["timeout"] = int64(c.timeout / time.Millisecond)
+	}
+	return c.client.Call(string(c.procedure), options, args, nil)
+}
+
+type dynamicAuthenticator struct {
+	dynamicCaller
+}
+
+// NewDynamicAuthenticator creates an authenticator that delegates to a
+// procedure registered on the realm, typically by a separate auth service.
+//
+// To challenge a client, the procedure is called with "challenge" and the HELLO
+// details, and returns the challenge extra as a dictionary. To authenticate the
+// client's response, it is called with "authenticate", the challenge extra and
+// the signature, and returns the WELCOME details, such as the authid and
+// authrole. The procedure returns an error to reject the client.
+//
+// The authenticator uses the realm's local client, so it must not be shared
+// between realms. Calls that take longer than the timeout fail, 0 meaning no
+// timeout.
+func NewDynamicAuthenticator(procedure URI, timeout time.Duration) CRAuthenticator {
+	return &dynamicAuthenticator{dynamicCaller{procedure: procedure, timeout: timeout}}
+}
+
+func (a *dynamicAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	return a.callForDict("challenge", details)
+}
+
+func (a *dynamicAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	return a.callForDict("authenticate", challenge, signature)
+}
+
+// callForDict calls the procedure, and returns its dictionary result.
+func (a *dynamicAuthenticator) callForDict(args ...interface{}) (map[string]interface{}, error) {
+	result, err := a.call(args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(result.Arguments) == 0 || result.Arguments[0] == nil {
+		return make(map[string]interface{}), nil
+	}
+	if dict, ok := result.Arguments[0].(map[string]interface{}); ok {
+		return dict, nil
+	}
+	return nil, fmt.Errorf("%s returned %v, expected a dictionary", a.procedure, result.Arguments[0])
+}
+
+// DynamicAuthorizerConfig configures an authorizer that delegates to a
+// procedure registered on the realm.
+type DynamicAuthorizerConfig struct {
+	// Procedure is called with the session's details, the URI, the action
+	// ("call", "register", "publish" or "subscribe") and the match policy
+	// ("exact", "prefix" or "wildcard"), and returns true if the action is
+	// allowed. Subscriptions and registrations with a prefix or wildcard match
+	// policy should only be allowed if the action is allowed for every URI
+	// the pattern can match; calls and publications are always "exact".
+	Procedure URI
+	// Timeout is how long to wait for the procedure, 0 for no timeout.
+	Timeout time.Duration
+	// CacheTTL is how long decisions are cached for a session, 0 to call the
+	// procedure for every request.
+	CacheTTL time.Duration
+	// TrustedRoles are authroles that are allowed everything without calling
+	// the procedure. The session that registers the procedure needs one of
+	// them, as its requests can't be authorized by the procedure itself.
+	TrustedRoles []string
+}
+
+type dynamicAuthorization struct {
+	uri    URI
+	action string
+	match  string
+}
+
+type dynamicDecision struct {
+	allowed bool
+	expires time.Time
+}
+
+type dynamicAuthorizer struct {
+	dynamicCaller
+	cacheTTL time.Duration
+	trusted  map[string]bool
+	cache    map[*Session]map[dynamicAuthorization]dynamicDecision
+	lock     sync.Mutex
+}
+
+// NewDynamicAuthorizer creates an authorizer that delegates to a procedure
+// registered on the realm, typically by a separate auth service.
+//
+// Only calls, registrations, publications and subscriptions are authorized by
+// the procedure; other messages are always allowed. The authorizer uses the
+// realm's local client, so it must not be shared between realms.
+func NewDynamicAuthorizer(config DynamicAuthorizerConfig) Authorizer {
+	a := &dynamicAuthorizer{
+		dynamicCaller: dynamicCaller{procedure: config.Procedure, timeout: config.Timeout},
+		cacheTTL:      config.CacheTTL,
+		trusted:       make(map[string]bool),
+		cache:         make(map[*Session]map[dynamicAuthorization]dynamicDecision),
+	}
+	for _, role := range config.TrustedRoles {
+		a.trusted[role] = true
+	}
+	return a
+}
+
+func (a *dynamicAuthorizer) Authorize(session *Session, msg Message) (bool, error) {
+	if a.trusted[session.AuthRole] {
+		return true, nil
+	}
+	switch msg := msg.(type) {
+	case *Publish:
+		return a.authorize(session, msg.Topic, "publish", MatchExact)
+	case *Subscribe:
+		match, _ := matchPolicy(msg.Options)
+		return a.authorize(session, msg.Topic, "subscribe", match)
+	case *Register:
+		match, _ := matchPolicy(msg.Options)
+		return a.authorize(session, msg.Procedure, "register", match)
+	case *Call:
+		return a.authorize(session, msg.Procedure, "call", MatchExact)
+	}
+	return true, nil
+}
+
+// authorize returns the cached decision for an action, or calls the procedure
+// for it.
+func (a *dynamicAuthorizer) authorize(session *Session, uri URI, action, match string) (bool, error) {
+	key := dynamicAuthorization{uri, action, match}
+	a.lock.Lock()
+	decision, ok := a.cache[session][key]
+	a.lock.Unlock()
+	if ok && time.Now().Before(decision.expires) {
+		return decision.allowed, nil
+	}
+
+	details := session.authDetails()
+	details["session"] = session.Id
+	result, err := a.call(details, string(uri), action, match)
+	if err != nil {
+		return false, err
+	}
+	allowed, ok := false, len(result.Arguments) > 0
+	if ok {
+		allowed, ok = result.Arguments[0].(bool)
+	}
+	if !ok {
+		return false, fmt.Errorf("%s returned %v, expected a boolean", a.procedure, result.Arguments)
+	}
+
+	if a.cacheTTL > 0 {
+		a.lock.Lock()
+		if _, ok := a.cache[session]; !ok {
+			a.cache[session] = make(map[dynamicAuthorization]dynamicDecision)
+		}
+		a.cache[session][key] = dynamicDecision{allowed, time.Now().Add(a.cacheTTL)}
+		a.lock.Unlock()
+	}
+	return allowed, nil
+}
+
+// RemoveSession forgets the decisions cached for a session.
+func (a *dynamicAuthorizer) RemoveSession(session *Session) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.cache, session)
+}
@@ -1,9 +1,6 @@
 package main
 
 import (
-	"crypto/hmac"
-	"crypto/sha256"
-	"encoding/base64"
 	"fmt"
 	"log"
 	"time"
@@ -12,25 +9,11 @@ import (
 	"gopkg.in/jcelliott/turnpike.v2"
 )
 
-var password []byte
-
-func exampleAuthFunc(hello map[string]interface{}, c map[string]interface{}) (string, map[string]interface{}, error) {
-	challenge, ok := c["challenge"].(string)
-	if !ok {
-		log.Fatal("no challenge data recieved")
-	}
-	mac := hmac.New(sha256.New, password)
-	mac.Write([]byte(challenge))
-	signature := mac.Sum(nil)
-	return base64.StdEncoding.EncodeToString(signature), nil, nil
-}
-
 func main() {
 	turnpike.Debug()
 	fmt.Println("Hint: the password is 'password'")
 	fmt.Print("Password: ")
-	var err error
-	password, err = gopass.GetPasswd()
+	password, err := gopass.GetPasswd()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -39,8 +22,8 @@ func main() {
 	if err != nil {
 		log.Fatal(err)
 	}
-	c.Auth = map[string]turnpike.AuthFunc{"example-auth": exampleAuthFunc}
-	_, err = c.JoinRealm("turnpike.examples", nil)
+	c.Auth = map[string]turnpike.AuthFunc{"wampcra": turnpike.WampCRAAuthFunc(string(password))}
+	_, err = c.JoinRealm("turnpike.examples", map[string]interface{}{"authid": "joe"})
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -0,0 +1,174 @@
+package turnpike
+
+import (
+	"sort"
+	"time"
+)
+
+// EventHistory configures the events the broker keeps for a topic.
+type EventHistory struct {
+	// Limit is the maximum number of events to keep, 0 for no limit.
+	Limit int
+	// MaxAge is how long to keep events, 0 for no limit.
+	MaxAge time.Duration
+}
+
+// storedEvent is an event kept by the broker, either in a topic's history or
+// as the topic's retained event.
+type storedEvent struct {
+	publication ID
+	topic       URI
+	timestamp   time.Time
+	args        []interface{}
+	kwargs      map[string]interface{}
+	details     map[string]interface{}
+}
+
+// event returns the EVENT message that delivers the stored event to a
+// subscription with the given match policy.
+func (e *storedEvent) event(subscription ID, match string, retained bool) *Event {
+	details := make(map[string]interface{})
+	for k, v := range e.details {
+		details[k] = v
+	}
+	if match != MatchExact {
+		details["topic"] = e.topic
+	}
+	if retained {
+		details["retained"] = true
+	}
+	return &Event{
+		Subscription: subscription,
+		Publication:  e.publication,
+		Details:      details,
+		Arguments:    e.args,
+		ArgumentsKw:  e.kwargs,
+	}
+}
+
+// eventHistory is the history of events published to a topic.
+type eventHistory struct {
+	EventHistory
+	// events in the order they were published
+	events []*storedEvent
+}
+
+// add appends an event to the history, and drops the events that no longer
+// fit.
+func (h *eventHistory) add(e *storedEvent) {
+	h.events = append(h.events, e)
+	h.trim(e.timestamp)
+}
+
+// expired reports whether an event is older than the history's maximum age.
+func (h *eventHistory) expired(e *storedEvent, now time.Time) bool {
+	return h.MaxAge > 0 && now.Sub(e.timestamp) > h.MaxAge
+}
+
+// trim drops events older than the history's maximum age, and the oldest
+// events beyond its limit.
+func (h *eventHistory) trim(now time.Time) {
+	start := 0
+	for start < len(h.events) && h.expired(h.events[start], now) {
+		start++
+	}
+	if h.Limit > 0 && len(h.events)-start > h.Limit {
+		start = len(h.events) - h.Limit
+	}
+	h.events = h.events[start:]
+}
+
+// setHistory configures the topics for which the broker keeps a history of
+// events.
+func (br *defaultBroker) setHistory(config map[URI]EventHistory) {
+	br.eventsLock.Lock()
+	defer br.eventsLock.Unlock()
+
+	br.history = make(map[URI]*eventHistory)
+	for topic, h := range config {
+		br.history[topic] = &eventHistory{EventHistory: h}
+	}
+	for topic := range br.retained {
+		if _, ok := br.history[topic]; !ok {
+			delete(br.retained, topic)
+		}
+	}
+}
+
+// store keeps a published event in the topic's history, if it has one, and
+// as the topic's retained event if the publisher asked for it. Topics without
+// a history don't keep a retained event either, so that publishers can't make
+// the broker keep events for any number of topics.
+//
+// Events for a subset of the subscribers are not stored, so that they can't
+// be read by other subscribers later on.
+func (br *defaultBroker) store(msg *Publish, publication ID, details map[string]interface{}) {
+	for _, option := range []string{"exclude", "eligible", "exclude_authid", "eligible_authid", "exclude_authrole", "eligible_authrole"} {
+		if _, ok := msg.Options[option]; ok {
+			return
+		}
+	}
+	e := &storedEvent{
+		publication: publication,
+		topic:       msg.Topic,
+		timestamp:   time.Now(),
+		args:        msg.Arguments,
+		kwargs:      msg.ArgumentsKw,
+		details:     details,
+	}
+
+	br.eventsLock.Lock()
+	defer br.eventsLock.Unlock()
+	h, ok := br.history[msg.Topic]
+	if !ok {
+		return
+	}
+	h.add(e)
+	if retain, _ := msg.Options["retain"].(bool); retain {
+		br.retained[msg.Topic] = e
+	}
+}
+
+// sendRetained sends the retained events of all topics that match a
+// subscription to a new subscriber, and drops the expired ones.
+func (br *defaultBroker) sendRetained(sub *Session, subscription ID, match string, topic URI) {
+	br.eventsLock.Lock()
+	var events []*storedEvent
+	now := time.Now()
+	for t, e := range br.retained {
+		if h, ok := br.history[t]; !ok || h.expired(e, now) {
+			delete(br.retained, t)
+		} else if matchURI(match, topic, t) {
+			events = append(events, e)
+		}
+	}
+	br.eventsLock.Unlock()
+
+	for _, e := range events {
+		sub.Send(e.event(subscription, match, true))
+	}
+}
+
+// events returns the stored events of all topics that match a subscription,
+// in the order they were published.
+func (br *defaultBroker) events(match string, topic URI) []*storedEvent {
+	br.eventsLock.Lock()
+	defer br.eventsLock.Unlock()
+
+	var events []*storedEvent
+	now := time.Now()
+	for t, h := range br.history {
+		if matchURI(match, topic, t) {
+			h.trim(now)
+			events = append(events, h.events...)
+		}
+	}
+	sort.Sort(byTimestamp(events))
+	return events
+}
+
+type byTimestamp []*storedEvent
+
+func (s byTimestamp) Len() int           { return len(s) }
+func (s byTimestamp) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byTimestamp) Less(i, j int) bool { return s[i].timestamp.Before(s[j].timestamp) }
@@ -0,0 +1,289 @@
+package turnpike
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// JWTConfig configures an authenticator that accepts JSON Web Tokens as WAMP
+// tickets.
+type JWTConfig struct {
+	// Keys used to verify tokens, by key ID. Tokens without a key ID are
+	// verified with the key with an empty ID, or the only key if there is just
+	// one. Keys are []byte for HS256, *rsa.PublicKey for RS256 and
+	// *ecdsa.PublicKey for ES256.
+	Keys map[string]interface{}
+	// JWKSFile is the path of a JSON Web Key Set file to load more keys from.
+	JWKSFile string
+	// Issuer and Audience, if set, must match the "iss" and "aud" claims.
+	Issuer   string
+	Audience string
+	// AuthIdClaim and AuthRoleClaim are the claims that hold the authid and
+	// authrole of the session. They default to "sub" and "role".
+	AuthIdClaim   string
+	AuthRoleClaim string
+	// ExtraClaims are copied into the authextra WELCOME details.
+	ExtraClaims []string
+	// Leeway allows for clock skew when checking the "exp" and "nbf" claims.
+	Leeway time.Duration
+}
+
+type jwtAuthenticator struct {
+	JWTConfig
+}
+
+// NewJWTAuthenticator creates an authenticator, for the "ticket" authmethod,
+// that accepts JSON Web Tokens signed with HS256, RS256 or ES256.
+//
+// The token must be signed with one of the configured keys, must not be
+// expired, and must match the configured issuer and audience.
+func NewJWTAuthenticator(config JWTConfig) (CRAuthenticator, error) {
+	keys := make(map[string]interface{})
+	for kid, key := range config.Keys {
+		keys[kid] = key
+	}
+	if config.JWKSFile != "" {
+		jwks, err := LoadJWKS(config.JWKSFile)
+		if err != nil {
+			return nil, err
+		}
+		for kid, key := range jwks {
+			keys[kid] = key
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no keys to verify tokens with")
+	}
+	config.Keys = keys
+	if config.AuthIdClaim == "" {
+		config.AuthIdClaim = "sub"
+	}
+	if config.AuthRoleClaim == "" {
+		config.AuthRoleClaim = "role"
+	}
+	return &jwtAuthenticator{config}, nil
+}
+
+func (a *jwtAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	return make(map[string]interface{}), nil
+}
+
+func (a *jwtAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	claims, err := a.verify(signature)
+	if err != nil {
+		return nil, err
+	}
+	authid, _ := claims[a.AuthIdClaim].(string)
+	if authid == "" {
+		return nil, fmt.Errorf("token has no %s claim", a.AuthIdClaim)
+	}
+	details := map[string]interface{}{
+		"authid":       authid,
+		"authprovider": "jwt",
+	}
+	if authrole, ok := claims[a.AuthRoleClaim].(string); ok {
+		details["authrole"] = authrole
+	}
+	if len(a.ExtraClaims) > 0 {
+		authextra := make(map[string]interface{})
+		for _, claim := range a.ExtraClaims {
+			if v, ok := claims[claim]; ok {
+				authextra[claim] = v
+			}
+		}
+		details["authextra"] = authextra
+	}
+	return details, nil
+}
+
+// verify checks the token's signature and claims, and returns the claims.
+func (a *jwtAuthenticator) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed token signature: %v", err)
+	}
+	key, err := a.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(jwtTime(exp).Add(a.Leeway)) {
+		return nil, fmt.Errorf("token has expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(jwtTime(nbf).Add(-a.Leeway)) {
+		return nil, fmt.Errorf("token is not valid yet")
+	}
+	if a.Issuer != "" && claims["iss"] != a.Issuer {
+		return nil, fmt.Errorf("token was not issued by %s", a.Issuer)
+	}
+	if a.Audience != "" && !jwtAudience(claims["aud"], a.Audience) {
+		return nil, fmt.Errorf("token is not intended for %s", a.Audience)
+	}
+	return claims, nil
+}
+
+// key returns the key with the given key ID.
+func (a *jwtAuthenticator) key(kid string) (interface{}, error) {
+	if key, ok := a.Keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(a.Keys) == 1 {
+		for _, key := range a.Keys {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key: %q", kid)
+}
+
+// verifyJWTSignature verifies the signature of a token with the key, which
+// must be of the right type for the algorithm.
+func verifyJWTSignature(alg string, key interface{}, input string, sig []byte) error {
+	hash := sha256.Sum256([]byte(input))
+	switch key := key.(type) {
+	case []byte:
+		if alg == "HS256" {
+			mac := hmac.New(sha256.New, key)
+			mac.Write([]byte(input))
+			if !hmac.Equal(sig, mac.Sum(nil)) {
+				return fmt.Errorf("invalid token signature")
+			}
+			return nil
+		}
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], sig); err != nil {
+				return fmt.Errorf("invalid token signature")
+			}
+			return nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" {
+			if len(sig) != 64 {
+				return fmt.Errorf("invalid token signature")
+			}
+			r, s := new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])
+			if !ecdsa.Verify(key, hash[:], r, s) {
+				return fmt.Errorf("invalid token signature")
+			}
+			return nil
+		}
+	}
+	return fmt.Errorf("unsupported token algorithm %q for key %T", alg, key)
+}
+
+func decodeJWTSegment(segment string, v interface{}) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+func jwtTime(seconds float64) time.Time {
+	return time.Unix(int64(seconds), 0)
+}
+
+// jwtAudience reports whether the "aud" claim, a string or a list of strings,
+// contains the audience.
+func jwtAudience(claim interface{}, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// LoadJWKS loads the keys in a JSON Web Key Set file, by key ID. It supports
+// "oct" keys for HS256, "RSA" keys for RS256 and "EC" P-256 keys for ES256.
+func LoadJWKS(path string) (map[string]interface{}, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var jwks struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			K   string `json:"k"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			Crv string `json:"crv"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &jwks); err != nil {
+		return nil, fmt.Errorf("error parsing JWKS file: %v", err)
+	}
+
+	keys := make(map[string]interface{})
+	for _, jwk := range jwks.Keys {
+		var params [][]byte
+		for _, s := range []string{jwk.K, jwk.N, jwk.E, jwk.X, jwk.Y} {
+			b, err := base64.RawURLEncoding.DecodeString(s)
+			if err != nil {
+				return nil, fmt.Errorf("error parsing key %q: %v", jwk.Kid, err)
+			}
+			params = append(params, b)
+		}
+		k, n, e, x, y := params[0], params[1], params[2], params[3], params[4]
+
+		switch jwk.Kty {
+		case "oct":
+			keys[jwk.Kid] = k
+		case "RSA":
+			keys[jwk.Kid] = &rsa.PublicKey{
+				N: new(big.Int).SetBytes(n),
+				E: int(new(big.Int).SetBytes(e).Int64()),
+			}
+		case "EC":
+			if jwk.Crv != "P-256" {
+				return nil, fmt.Errorf("unsupported curve %q for key %q", jwk.Crv, jwk.Kid)
+			}
+			keys[jwk.Kid] = &ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(x),
+				Y:     new(big.Int).SetBytes(y),
+			}
+		default:
+			return nil, fmt.Errorf("unsupported key type %q for key %q", jwk.Kty, jwk.Kid)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,150 @@
+package turnpike
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func testJWT(alg, kid string, key interface{}, claims map[string]interface{}) string {
+	header := map[string]interface{}{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	input := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	hash := sha256.Sum256([]byte(input))
+
+	var sig []byte
+	switch key := key.(type) {
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(input))
+		sig = mac.Sum(nil)
+	case *rsa.PrivateKey:
+		sig, _ = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	case *ecdsa.PrivateKey:
+		r, s, _ := ecdsa.Sign(rand.Reader, key, hash[:])
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	}
+	return input + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestJWTAuthenticator(t *testing.T) {
+	Convey("Given a JWT authenticator with HMAC, RSA and ECDSA keys", t, func() {
+		secret := []byte("super-secret")
+		rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		So(err, ShouldBeNil)
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		auth, err := NewJWTAuthenticator(JWTConfig{
+			Keys: map[string]interface{}{
+				"hmac": secret,
+				"rsa":  &rsaKey.PublicKey,
+				"ec":   &ecKey.PublicKey,
+			},
+			Issuer:      "https://id.acme.com",
+			Audience:    "turnpike",
+			ExtraClaims: []string{"email"},
+		})
+		So(err, ShouldBeNil)
+		claims := map[string]interface{}{
+			"sub":   "alice",
+			"role":  "user",
+			"email": "alice@acme.com",
+			"iss":   "https://id.acme.com",
+			"aud":   []string{"turnpike", "other"},
+			"exp":   time.Now().Add(time.Hour).Unix(),
+		}
+
+		Convey("Valid tokens should be accepted for each algorithm", func() {
+			for _, token := range []string{
+				testJWT("HS256", "hmac", secret, claims),
+				testJWT("RS256", "rsa", rsaKey, claims),
+				testJWT("ES256", "ec", ecKey, claims),
+			} {
+				details, err := auth.Authenticate(nil, token)
+				So(err, ShouldBeNil)
+				So(details["authid"], ShouldEqual, "alice")
+				So(details["authrole"], ShouldEqual, "user")
+				So(details["authextra"], ShouldResemble, map[string]interface{}{"email": "alice@acme.com"})
+			}
+		})
+
+		Convey("A token signed with the wrong key should be rejected", func() {
+			_, err := auth.Authenticate(nil, testJWT("HS256", "hmac", []byte("guess"), claims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A token with an algorithm that doesn't match the key should be rejected", func() {
+			_, err := auth.Authenticate(nil, testJWT("HS256", "rsa", secret, claims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("An expired token should be rejected", func() {
+			claims["exp"] = time.Now().Add(-time.Minute).Unix()
+			_, err := auth.Authenticate(nil, testJWT("HS256", "hmac", secret, claims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A token that is not valid yet should be rejected", func() {
+			claims["nbf"] = time.Now().Add(time.Minute).Unix()
+			_, err := auth.Authenticate(nil, testJWT("HS256", "hmac", secret, claims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A token for another audience should be rejected", func() {
+			claims["aud"] = "other"
+			_, err := auth.Authenticate(nil, testJWT("HS256", "hmac", secret, claims))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A token from another issuer should be rejected", func() {
+			claims["iss"] = "https://evil.com"
+			_, err := auth.Authenticate(nil, testJWT("HS256", "hmac", secret, claims))
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("Given a JWKS file", t, func() {
+		ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		So(err, ShouldBeNil)
+		b64 := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+		jwks, _ := json.Marshal(map[string]interface{}{
+			"keys": []map[string]interface{}{
+				{"kid": "ec", "kty": "EC", "crv": "P-256", "x": b64(ecKey.X.Bytes()), "y": b64(ecKey.Y.Bytes())},
+				{"kid": "hmac", "kty": "oct", "k": b64([]byte("super-secret"))},
+			},
+		})
+		f, err := ioutil.TempFile("", "jwks")
+		So(err, ShouldBeNil)
+		defer os.Remove(f.Name())
+		f.Write(jwks)
+		f.Close()
+
+		Convey("Tokens signed with its keys should be accepted", func() {
+			auth, err := NewJWTAuthenticator(JWTConfig{JWKSFile: f.Name()})
+			So(err, ShouldBeNil)
+			claims := map[string]interface{}{"sub": "device-1"}
+			_, err = auth.Authenticate(nil, testJWT("ES256", "ec", ecKey, claims))
+			So(err, ShouldBeNil)
+			_, err = auth.Authenticate(nil, testJWT("HS256", "hmac", []byte("super-secret"), claims))
+			So(err, ShouldBeNil)
+		})
+	})
+}
@@ -0,0 +1,121 @@
+package turnpike
+
+import "strings"
+
+// Match policies for pattern-based subscriptions and registrations.
+const (
+	// Match the URI exactly. This is the default policy.
+	MatchExact = "exact"
+	// Match any URI that starts with the given URI.
+	MatchPrefix = "prefix"
+	// Match any URI with the same number of components, where empty components
+	// in the given URI match any value.
+	MatchWildcard = "wildcard"
+)
+
+// matchPolicy returns the match policy requested in a SUBSCRIBE or REGISTER
+// options map, and false if the policy is not supported.
+func matchPolicy(options map[string]interface{}) (string, bool) {
+	match, ok := options["match"]
+	if !ok {
+		return MatchExact, true
+	}
+	switch match, _ := match.(string); match {
+	case MatchExact, MatchPrefix, MatchWildcard:
+		return match, true
+	}
+	return "", false
+}
+
+// matchURI reports whether uri matches pattern under the given policy.
+func matchURI(policy string, pattern, uri URI) bool {
+	switch policy {
+	case MatchPrefix:
+		return strings.HasPrefix(string(uri), string(pattern))
+	case MatchWildcard:
+		return matchWildcard(pattern, uri)
+	default:
+		return pattern == uri
+	}
+}
+
+// matchWildcard reports whether uri matches pattern, where empty components of
+// pattern match any single component of uri.
+func matchWildcard(pattern, uri URI) bool {
+	p := strings.Split(string(pattern), ".")
+	u := strings.Split(string(uri), ".")
+	if len(p) != len(u) {
+		return false
+	}
+	for i := range p {
+		if p[i] != "" && p[i] != u[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// coversPattern reports whether a rule with match policy rulePolicy matches
+// every URI that pattern can match under policy.
+func coversPattern(rulePolicy string, rule URI, policy string, pattern URI) bool {
+	switch policy {
+	case MatchPrefix:
+		return rulePolicy == MatchPrefix && strings.HasPrefix(string(pattern), string(rule))
+	case MatchWildcard:
+		switch rulePolicy {
+		case MatchPrefix:
+			return strings.HasPrefix(wildcardPrefix(pattern), string(rule))
+		case MatchWildcard:
+			return matchWildcard(rule, pattern)
+		}
+		return false
+	default:
+		return matchURI(rulePolicy, rule, pattern)
+	}
+}
+
+// mayOverlap reports whether a rule with match policy rulePolicy may match
+// some of the URIs that pattern can match under policy. It errs on the side of
+// reporting an overlap.
+func mayOverlap(rulePolicy string, rule URI, policy string, pattern URI) bool {
+	switch {
+	case rulePolicy == MatchExact:
+		return matchURI(policy, pattern, rule)
+	case policy == MatchExact:
+		return matchURI(rulePolicy, rule, pattern)
+	case rulePolicy == MatchWildcard && policy == MatchWildcard:
+		r := strings.Split(string(rule), ".")
+		p := strings.Split(string(pattern), ".")
+		if len(r) != len(p) {
+			return false
+		}
+		for i := range r {
+			if r[i] != "" && p[i] != "" && r[i] != p[i] {
+				return false
+			}
+		}
+		return true
+	}
+	r, p := string(rule), string(pattern)
+	if rulePolicy == MatchWildcard {
+		r = wildcardPrefix(rule)
+	}
+	if policy == MatchWildcard {
+		p = wildcardPrefix(pattern)
+	}
+	return strings.HasPrefix(r, p) || strings.HasPrefix(p, r)
+}
+
+// wildcardPrefix returns the longest string that all the URIs matched by a
+// wildcard pattern start with.
+func wildcardPrefix(pattern URI) string {
+	components := strings.Split(string(pattern), ".")
+	for i, c := range components {
+		if c == "" && i == 0 {
+			return ""
+		} else if c == "" {
+			return strings.Join(components[:i], ".") + "."
+		}
+	}
+	return string(pattern)
+}
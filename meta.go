@@ -0,0 +1,704 @@
+package turnpike
+
+import (
+	"strings"
+	"time"
+)
+
+const (
+	// A session could not be found for the given session ID.
+	ErrNoSuchSession = URI("wamp.error.no_such_session")
+
+	// The default reason sent to sessions killed through the meta API.
+	closeKilled = URI("wamp.close.killed")
+)
+
+// isMetaURI reports whether uri belongs to the WAMP meta API, which is
+// reserved for the router.
+func isMetaURI(uri URI) bool {
+	return strings.HasPrefix(string(uri), "wamp.")
+}
+
+// mayMatchMeta reports whether a subscription or registration pattern, with
+// the given match policy, may match a URI of the WAMP meta API.
+func mayMatchMeta(policy string, pattern URI) bool {
+	switch policy {
+	case MatchPrefix:
+		return isMetaURI(pattern) || strings.HasPrefix("wamp.", string(pattern))
+	case MatchWildcard:
+		components := strings.Split(string(pattern), ".")
+		return len(components) > 1 && (components[0] == "" || components[0] == "wamp")
+	default:
+		return isMetaURI(pattern)
+	}
+}
+
+// do runs fn on the realm's goroutine and waits for it to return.
+func (r *Realm) do(fn func()) {
+	sync := make(chan struct{})
+	r.acts <- func() {
+		fn()
+		sync <- struct{}{}
+	}
+	<-sync
+}
+
+// registerMetaAPI registers the procedures of the meta API with the realm's
+// local client. The subscription and registration meta APIs are only
+// available with the default broker and dealer.
+func (r *Realm) registerMetaAPI() {
+	r.registerMeta(map[string]MethodHandler{
+		"wamp.session.count":            r.sessionCount,
+		"wamp.session.list":             r.sessionList,
+		"wamp.session.get":              r.sessionGet,
+		"wamp.session.kill":             r.sessionKill,
+		"wamp.session.kill_by_authid":   r.sessionKillByAuthId,
+		"wamp.session.kill_by_authrole": r.sessionKillByAuthRole,
+		"wamp.session.add_testament":    r.sessionAddTestament,
+		"wamp.session.flush_testaments": r.sessionFlushTestaments,
+	})
+	if br, ok := r.Broker.(*defaultBroker); ok {
+		r.registerMeta(map[string]MethodHandler{
+			"wamp.subscription.list":              br.subscriptionList,
+			"wamp.subscription.lookup":            br.subscriptionLookup,
+			"wamp.subscription.match":             br.subscriptionMatch,
+			"wamp.subscription.get":               br.subscriptionGet,
+			"wamp.subscription.list_subscribers":  br.subscriptionListSubscribers,
+			"wamp.subscription.count_subscribers": br.subscriptionCountSubscribers,
+			"wamp.subscription.get_events":        br.subscriptionGetEvents,
+		})
+	}
+	if d, ok := r.Dealer.(*defaultDealer); ok {
+		r.registerMeta(map[string]MethodHandler{
+			"wamp.registration.list":          d.registrationList,
+			"wamp.registration.lookup":        d.registrationLookup,
+			"wamp.registration.match":         d.registrationMatch,
+			"wamp.registration.get":           d.registrationGet,
+			"wamp.registration.list_callees":  d.registrationListCallees,
+			"wamp.registration.count_callees": d.registrationCountCallees,
+		})
+	}
+}
+
+func (r *Realm) registerMeta(procedures map[string]MethodHandler) {
+	for procedure, fn := range procedures {
+		if err := r.localClient.Register(procedure, fn, nil); err != nil {
+			log.Printf("error registering %s: %v", procedure, err)
+		}
+	}
+}
+
+// sessions returns the sessions joined to the realm, excluding the realm's
+// own session, that satisfy keep.
+func (r *Realm) sessions(keep func(*Session) bool) []*Session {
+	var sessions []*Session
+	r.do(func() {
+		for id, sess := range r.clients {
+			if id != r.localId && keep(sess) {
+				sessions = append(sessions, sess)
+			}
+		}
+	})
+	return sessions
+}
+
+// authRoleFilter returns a filter that keeps sessions with one of the
+// authroles in the first positional argument, or all sessions if there is no
+// such argument.
+func authRoleFilter(args []interface{}) (func(*Session) bool, bool) {
+	if len(args) == 0 || args[0] == nil {
+		return func(*Session) bool { return true }, true
+	}
+	roles := make(map[string]bool)
+	switch filter := args[0].(type) {
+	case []string:
+		for _, role := range filter {
+			roles[role] = true
+		}
+	case []interface{}:
+		for _, role := range filter {
+			role, ok := role.(string)
+			if !ok {
+				return nil, false
+			}
+			roles[role] = true
+		}
+	default:
+		return nil, false
+	}
+	return func(sess *Session) bool {
+		return roles[sess.AuthRole]
+	}, true
+}
+
+// sessionCount implements wamp.session.count, which returns the number of
+// sessions joined to the realm, optionally filtered by authrole.
+func (r *Realm) sessionCount(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	filter, ok := authRoleFilter(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	return &CallResult{Args: []interface{}{len(r.sessions(filter))}}
+}
+
+// sessionList implements wamp.session.list, which returns the IDs of the
+// sessions joined to the realm, optionally filtered by authrole.
+func (r *Realm) sessionList(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	filter, ok := authRoleFilter(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	ids := []ID{}
+	for _, sess := range r.sessions(filter) {
+		ids = append(ids, sess.Id)
+	}
+	return &CallResult{Args: []interface{}{ids}}
+}
+
+// sessionGet implements wamp.session.get, which returns the details of a
+// session.
+func (r *Realm) sessionGet(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	id, ok := idArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	sessions := r.sessions(func(sess *Session) bool { return sess.Id == id })
+	if len(sessions) == 0 {
+		return &CallResult{Err: ErrNoSuchSession}
+	}
+	sess := sessions[0]
+	info := sess.authDetails()
+	info["session"] = sess.Id
+	return &CallResult{Args: []interface{}{info}}
+}
+
+// sessionKill implements wamp.session.kill, which closes a session other
+// than the caller's.
+func (r *Realm) sessionKill(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	id, ok := idArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	if id == callerId(details) {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	sessions := r.sessions(func(sess *Session) bool { return sess.Id == id })
+	if len(sessions) == 0 {
+		return &CallResult{Err: ErrNoSuchSession}
+	}
+	kill(sessions, kwargs)
+	return &CallResult{}
+}
+
+// sessionKillByAuthId implements wamp.session.kill_by_authid, which closes
+// all sessions with the given authid, other than the caller's, and returns
+// their IDs.
+func (r *Realm) sessionKillByAuthId(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	if len(args) == 0 {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	authid, ok := args[0].(string)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	caller := callerId(details)
+	sessions := r.sessions(func(sess *Session) bool {
+		return sess.Id != caller && sess.AuthId == authid
+	})
+	kill(sessions, kwargs)
+	ids := []ID{}
+	for _, sess := range sessions {
+		ids = append(ids, sess.Id)
+	}
+	return &CallResult{Args: []interface{}{ids}}
+}
+
+// sessionKillByAuthRole implements wamp.session.kill_by_authrole, which
+// closes all sessions with the given authrole, other than the caller's, and
+// returns the number of sessions closed.
+func (r *Realm) sessionKillByAuthRole(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	if len(args) == 0 {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	authrole, ok := args[0].(string)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	caller := callerId(details)
+	sessions := r.sessions(func(sess *Session) bool {
+		return sess.Id != caller && sess.AuthRole == authrole
+	})
+	kill(sessions, kwargs)
+	return &CallResult{Args: []interface{}{len(sessions)}}
+}
+
+// Testament scopes.
+const (
+	// Publish the testament when the session is detached from its transport.
+	testamentDetached = "detached"
+	// Publish the testament when the session is destroyed. This is the
+	// default.
+	testamentDestroyed = "destroyed"
+)
+
+// A testament is an event that the realm publishes on behalf of a session
+// when the session leaves.
+type testament struct {
+	scope   string
+	publish *Publish
+}
+
+// testamentOptions are the publish options a testament may use. The others
+// are dropped, so that a testament can't disclose its session or choose its
+// subscribers.
+var testamentOptions = []string{"retain", "exclude_me"}
+
+// testamentScope returns the scope in the keyword arguments of a testament
+// procedure, and false if the scope is not valid.
+func testamentScope(kwargs map[string]interface{}) (string, bool) {
+	scope, ok := kwargs["scope"]
+	if !ok {
+		return testamentDestroyed, true
+	}
+	switch scope, _ := scope.(string); scope {
+	case testamentDetached, testamentDestroyed:
+		return scope, true
+	}
+	return "", false
+}
+
+// sessionAddTestament implements wamp.session.add_testament, which adds an
+// event to publish when the caller's session leaves the realm.
+//
+// The event is described by the topic, args and kwargs positional arguments,
+// and the publish_options and scope keyword arguments. The caller must be
+// allowed to publish to the topic, which can't be a meta topic.
+func (r *Realm) sessionAddTestament(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	topic, ok := uriArg(args)
+	if !ok || isMetaURI(topic) {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	scope, ok := testamentScope(kwargs)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	publish := &Publish{
+		Request: NewID(),
+		Options: make(map[string]interface{}),
+		Topic:   topic,
+	}
+	if len(args) > 1 {
+		publish.Arguments, _ = args[1].([]interface{})
+	}
+	if len(args) > 2 {
+		publish.ArgumentsKw, _ = args[2].(map[string]interface{})
+	}
+	options, _ := kwargs["publish_options"].(map[string]interface{})
+	for _, option := range testamentOptions {
+		if v, ok := options[option]; ok {
+			publish.Options[option] = v
+		}
+	}
+
+	caller := callerId(details)
+	var sess *Session
+	r.do(func() {
+		sess = r.clients[caller]
+	})
+	if sess == nil {
+		return &CallResult{Err: ErrNoSuchSession}
+	}
+	if isAuthz, err := r.Authorizer.Authorize(sess, publish); err != nil {
+		log.Printf("[%s] testament authorization failed: %v", sess, err)
+		return &CallResult{Err: ErrAuthorizationFailed}
+	} else if !isAuthz {
+		return &CallResult{Err: ErrNotAuthorized}
+	}
+	var msg Message = publish
+	r.Interceptor.Intercept(sess, &msg)
+	publish, ok = msg.(*Publish)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	joined := false
+	r.do(func() {
+		if _, joined = r.clients[caller]; joined {
+			r.testaments[caller] = append(r.testaments[caller], testament{scope, publish})
+		}
+	})
+	if !joined {
+		return &CallResult{Err: ErrNoSuchSession}
+	}
+	return &CallResult{}
+}
+
+// sessionFlushTestaments implements wamp.session.flush_testaments, which
+// removes the caller's testaments in the scope given in the keyword
+// arguments, and returns the number of testaments removed.
+func (r *Realm) sessionFlushTestaments(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	scope, ok := testamentScope(kwargs)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	caller := callerId(details)
+	flushed := 0
+	r.do(func() {
+		var kept []testament
+		for _, t := range r.testaments[caller] {
+			if t.scope == scope {
+				flushed++
+			} else {
+				kept = append(kept, t)
+			}
+		}
+		if len(kept) > 0 {
+			r.testaments[caller] = kept
+		} else {
+			delete(r.testaments, caller)
+		}
+	})
+	return &CallResult{Args: []interface{}{flushed}}
+}
+
+// publishTestaments publishes the testaments of a session that left the
+// realm, on behalf of the session, as they were authorized when they were
+// added. Sessions can't be resumed, so leaving both detaches and destroys the
+// session.
+//
+// It must be called on the realm's goroutine.
+func (r *Realm) publishTestaments(sess *Session) {
+	testaments := r.testaments[sess.Id]
+	delete(r.testaments, sess.Id)
+	for _, scope := range []string{testamentDetached, testamentDestroyed} {
+		for _, t := range testaments {
+			if t.scope == scope {
+				r.Broker.Publish(sess, r.preparePublish(t.publish))
+			}
+		}
+	}
+}
+
+// kill closes sessions with the reason given in kwargs, or wamp.close.killed.
+func kill(sessions []*Session, kwargs map[string]interface{}) {
+	reason := closeKilled
+	if r, ok := kwargs["reason"].(string); ok && r != "" {
+		reason = URI(r)
+	}
+	for _, sess := range sessions {
+		select {
+		case sess.kill <- reason:
+		default:
+			// the session is already being killed
+		}
+	}
+}
+
+// idArg returns the ID in the first positional argument.
+func idArg(args []interface{}) (ID, bool) {
+	if len(args) == 0 {
+		return 0, false
+	}
+	id, ok := toInt64(args[0])
+	return ID(id), ok
+}
+
+// uriArg returns the URI in the first positional argument.
+func uriArg(args []interface{}) (URI, bool) {
+	if len(args) == 0 {
+		return "", false
+	}
+	switch uri := args[0].(type) {
+	case string:
+		return URI(uri), true
+	case URI:
+		return uri, true
+	}
+	return "", false
+}
+
+// callerId returns the ID of the session that made a call to the meta API.
+func callerId(details map[string]interface{}) ID {
+	id, _ := toInt64(details["caller"])
+	return ID(id)
+}
+
+// subscriptionList implements wamp.subscription.list, which returns the IDs of
+// all subscriptions, grouped by match policy.
+func (br *defaultBroker) subscriptionList(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	br.lock.RLock()
+	defer br.lock.RUnlock()
+
+	list := make(map[string]interface{})
+	for _, match := range []string{MatchExact, MatchPrefix, MatchWildcard} {
+		ids := []ID{}
+		for _, id := range br.routesFor(match) {
+			ids = append(ids, id)
+		}
+		list[match] = ids
+	}
+	return &CallResult{Args: []interface{}{list}}
+}
+
+// subscriptionLookup implements wamp.subscription.lookup, which returns the ID
+// of the subscription to a topic with the match policy in the options, or nil.
+func (br *defaultBroker) subscriptionLookup(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	topic, ok := uriArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	var options map[string]interface{}
+	if len(args) > 1 {
+		options, _ = args[1].(map[string]interface{})
+	}
+	match, ok := matchPolicy(options)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	br.lock.RLock()
+	defer br.lock.RUnlock()
+	if id, ok := br.routesFor(match)[topic]; ok {
+		return &CallResult{Args: []interface{}{id}}
+	}
+	return &CallResult{Args: []interface{}{nil}}
+}
+
+// subscriptionMatch implements wamp.subscription.match, which returns the IDs
+// of all subscriptions that match a topic, or nil.
+func (br *defaultBroker) subscriptionMatch(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	topic, ok := uriArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	br.lock.RLock()
+	defer br.lock.RUnlock()
+	if ids := br.match(topic); len(ids) > 0 {
+		return &CallResult{Args: []interface{}{ids}}
+	}
+	return &CallResult{Args: []interface{}{nil}}
+}
+
+// subscriptionGet implements wamp.subscription.get, which returns the details
+// of a subscription.
+func (br *defaultBroker) subscriptionGet(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	id, ok := idArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	br.lock.RLock()
+	defer br.lock.RUnlock()
+	if _, ok := br.subscribers[id]; !ok {
+		return &CallResult{Err: ErrNoSuchSubscription}
+	}
+	return &CallResult{Args: []interface{}{br.details(id)}}
+}
+
+// subscriptionListSubscribers implements wamp.subscription.list_subscribers,
+// which returns the session IDs of the subscribers of a subscription.
+func (br *defaultBroker) subscriptionListSubscribers(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	id, ok := idArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	br.lock.RLock()
+	defer br.lock.RUnlock()
+	s, ok := br.subscribers[id]
+	if !ok {
+		return &CallResult{Err: ErrNoSuchSubscription}
+	}
+	ids := []ID{}
+	for sub := range s.subscribers {
+		ids = append(ids, sub.Id)
+	}
+	return &CallResult{Args: []interface{}{ids}}
+}
+
+// subscriptionCountSubscribers implements wamp.subscription.count_subscribers,
+// which returns the number of subscribers of a subscription.
+func (br *defaultBroker) subscriptionCountSubscribers(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	id, ok := idArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	br.lock.RLock()
+	defer br.lock.RUnlock()
+	s, ok := br.subscribers[id]
+	if !ok {
+		return &CallResult{Err: ErrNoSuchSubscription}
+	}
+	return &CallResult{Args: []interface{}{len(s.subscribers)}}
+}
+
+// subscriptionGetEvents implements wamp.subscription.get_events, which returns
+// the stored events of the topics that match a subscription, optionally
+// limited to the most recent ones. Only the subscribers of the subscription
+// may read its events.
+func (br *defaultBroker) subscriptionGetEvents(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	id, ok := idArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	limit := int64(0)
+	if len(args) > 1 {
+		if limit, ok = toInt64(args[1]); !ok || limit < 0 {
+			return &CallResult{Err: ErrInvalidArgument}
+		}
+	}
+
+	caller := callerId(details)
+	br.lock.RLock()
+	s, ok := br.subscribers[id]
+	topic := br.subscriptions[id]
+	subscribed := false
+	if ok {
+		for sub := range s.subscribers {
+			if sub.Id == caller {
+				subscribed = true
+				break
+			}
+		}
+	}
+	br.lock.RUnlock()
+	if !ok {
+		return &CallResult{Err: ErrNoSuchSubscription}
+	}
+	if !subscribed {
+		return &CallResult{Err: ErrNotAuthorized}
+	}
+
+	events := br.events(s.match, topic)
+	if limit > 0 && int64(len(events)) > limit {
+		events = events[int64(len(events))-limit:]
+	}
+	list := []interface{}{}
+	for _, e := range events {
+		list = append(list, map[string]interface{}{
+			"timestamp":    e.timestamp.UTC().Format(time.RFC3339Nano),
+			"subscription": id,
+			"publication":  e.publication,
+			"topic":        e.topic,
+			"args":         e.args,
+			"kwargs":       e.kwargs,
+			"details":      e.details,
+		})
+	}
+	return &CallResult{Args: []interface{}{list}}
+}
+
+// registrationList implements wamp.registration.list, which returns the IDs of
+// all registrations, grouped by match policy.
+func (d *defaultDealer) registrationList(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	list := make(map[string]interface{})
+	for _, match := range []string{MatchExact, MatchPrefix, MatchWildcard} {
+		ids := []ID{}
+		for _, id := range d.registrationsFor(match) {
+			ids = append(ids, id)
+		}
+		list[match] = ids
+	}
+	return &CallResult{Args: []interface{}{list}}
+}
+
+// registrationLookup implements wamp.registration.lookup, which returns the ID
+// of the registration of a procedure with the match policy in the options, or
+// nil.
+func (d *defaultDealer) registrationLookup(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	procedure, ok := uriArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+	var options map[string]interface{}
+	if len(args) > 1 {
+		options, _ = args[1].(map[string]interface{})
+	}
+	match, ok := matchPolicy(options)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if id, ok := d.registrationsFor(match)[procedure]; ok {
+		return &CallResult{Args: []interface{}{id}}
+	}
+	return &CallResult{Args: []interface{}{nil}}
+}
+
+// registrationMatch implements wamp.registration.match, which returns the ID
+// of the registration a call to a procedure would be routed to, or nil.
+func (d *defaultDealer) registrationMatch(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	procedure, ok := uriArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if id, ok := d.match(procedure); ok {
+		return &CallResult{Args: []interface{}{id}}
+	}
+	return &CallResult{Args: []interface{}{nil}}
+}
+
+// registrationGet implements wamp.registration.get, which returns the details
+// of a registration.
+func (d *defaultDealer) registrationGet(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	id, ok := idArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.procedures[id]; !ok {
+		return &CallResult{Err: ErrNoSuchRegistration}
+	}
+	return &CallResult{Args: []interface{}{d.details(id)}}
+}
+
+// registrationListCallees implements wamp.registration.list_callees, which
+// returns the session IDs of the callees of a registration.
+func (d *defaultDealer) registrationListCallees(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	id, ok := idArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	proc, ok := d.procedures[id]
+	if !ok {
+		return &CallResult{Err: ErrNoSuchRegistration}
+	}
+	ids := []ID{}
+	for _, callee := range proc.Endpoints {
+		ids = append(ids, callee.Id)
+	}
+	return &CallResult{Args: []interface{}{ids}}
+}
+
+// registrationCountCallees implements wamp.registration.count_callees, which
+// returns the number of callees of a registration.
+func (d *defaultDealer) registrationCountCallees(args []interface{}, kwargs map[string]interface{}, details map[string]interface{}) *CallResult {
+	id, ok := idArg(args)
+	if !ok {
+		return &CallResult{Err: ErrInvalidArgument}
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	proc, ok := d.procedures[id]
+	if !ok {
+		return &CallResult{Err: ErrNoSuchRegistration}
+	}
+	return &CallResult{Args: []interface{}{len(proc.Endpoints)}}
+}
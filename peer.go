@@ -26,6 +26,18 @@ type Peer interface {
 	Receive() <-chan Message
 }
 
+// transportPeer is implemented by peers that know the details of the
+// transport their client connected with, such as its address and TLS state.
+type transportPeer interface {
+	transportDetails() map[string]interface{}
+}
+
+// sessionBinder is implemented by peers that bind state of their transport to
+// a new session, such as an authentication cookie, before it is welcomed.
+type sessionBinder interface {
+	bindSession(sess *Session, realm URI)
+}
+
 // GetMessageTimeout is a convenience function to get a single message from a
 // peer within a specified period of time
 func GetMessageTimeout(p Peer, t time.Duration) (Message, error) {
@@ -0,0 +1,349 @@
+package turnpike
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	rawSocketMagic = 0x7F
+
+	// serializer IDs
+	rawSocketJSON    = 1
+	rawSocketMsgpack = 2
+	rawSocketCBOR    = 3
+
+	// frame types
+	rawSocketMessage = 0
+	rawSocketPing    = 1
+	rawSocketPong    = 2
+
+	// handshake errors
+	rawSocketErrSerializer  = 1
+	rawSocketErrLength      = 2
+	rawSocketErrReserved    = 3
+	rawSocketErrConnections = 4
+
+	// the largest message length that can be negotiated, 2^(9+15) bytes
+	rawSocketMaxLengthExp = 15
+	rawSocketTimeout      = 5 * time.Second
+)
+
+type rawSocketError byte
+
+func (e rawSocketError) Error() string {
+	switch e {
+	case rawSocketErrSerializer:
+		return "rawsocket: serializer unsupported"
+	case rawSocketErrLength:
+		return "rawsocket: maximum message length unacceptable"
+	case rawSocketErrReserved:
+		return "rawsocket: use of reserved bits"
+	case rawSocketErrConnections:
+		return "rawsocket: maximum connection count reached"
+	}
+	return fmt.Sprintf("rawsocket: handshake error %d", byte(e))
+}
+
+// rawSocketSerializer returns the serializer with the given RawSocket ID, or
+// nil if it isn't supported.
+func rawSocketSerializer(id byte) Serializer {
+	switch id {
+	case rawSocketJSON:
+		return new(JSONSerializer)
+	case rawSocketMsgpack:
+		return new(MessagePackSerializer)
+	case rawSocketCBOR:
+		return new(CBORSerializer)
+	}
+	return nil
+}
+
+// rawSocketLengthExp returns the exponent that announces a maximum message
+// length of at least n bytes, up to the largest one that can be announced.
+func rawSocketLengthExp(n int) byte {
+	var exp byte
+	for exp < rawSocketMaxLengthExp && rawSocketLength(exp) < n {
+		exp++
+	}
+	return exp
+}
+
+// rawSocketLength returns the maximum message length announced by exp.
+func rawSocketLength(exp byte) int {
+	return 1 << (9 + exp)
+}
+
+type rawSocketPeer struct {
+	conn       net.Conn
+	serializer Serializer
+	messages   chan Message
+	// maximum length of the messages the other end accepts, and of the ones we
+	// accept
+	sendLength    int
+	receiveLength int
+	closed        bool
+	sendMutex     sync.Mutex
+	// details of the connection on the router side, see transportDetails
+	transport map[string]interface{}
+}
+
+func newRawSocketPeer(conn net.Conn, serializer Serializer, sendLength, receiveLength int) *rawSocketPeer {
+	return &rawSocketPeer{
+		conn:          conn,
+		serializer:    serializer,
+		messages:      make(chan Message, 10),
+		sendLength:    sendLength,
+		receiveLength: receiveLength,
+	}
+}
+
+// NewRawSocketPeer connects to a WAMP router with the RawSocket transport, over
+// the network ("tcp" or "unix") at the address. dial is used to connect if it
+// isn't nil.
+func NewRawSocketPeer(serialization Serialization, network, addr string, dial DialFunc) (Peer, error) {
+	var id byte
+	switch serialization {
+	case JSON:
+		id = rawSocketJSON
+	case MSGPACK:
+		id = rawSocketMsgpack
+	case CBOR:
+		id = rawSocketCBOR
+	default:
+		return nil, fmt.Errorf("Unsupported serialization: %v", serialization)
+	}
+	if dial == nil {
+		dial = net.Dial
+	}
+	conn, err := dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(rawSocketTimeout))
+	handshake := []byte{rawSocketMagic, rawSocketMaxLengthExp<<4 | id, 0, 0}
+	if _, err := conn.Write(handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	if handshake[0] != rawSocketMagic {
+		conn.Close()
+		return nil, fmt.Errorf("rawsocket: invalid handshake reply")
+	}
+	if handshake[1]&0x0F == 0 {
+		conn.Close()
+		return nil, rawSocketError(handshake[1] >> 4)
+	}
+	if handshake[1]&0x0F != id {
+		conn.Close()
+		return nil, fmt.Errorf("rawsocket: router chose serializer %d instead of %d", handshake[1]&0x0F, id)
+	}
+
+	ep := newRawSocketPeer(conn, rawSocketSerializer(id), rawSocketLength(handshake[1]>>4), rawSocketLength(rawSocketMaxLengthExp))
+	go ep.run()
+	return ep, nil
+}
+
+// NewRawSocketClient creates a client connected to a WAMP router with the
+// RawSocket transport, over the network ("tcp" or "unix") at the address.
+func NewRawSocketClient(serialization Serialization, network, addr string, dial DialFunc) (*Client, error) {
+	p, err := NewRawSocketPeer(serialization, network, addr, dial)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(p), nil
+}
+
+func (ep *rawSocketPeer) Send(msg Message) error {
+	b, err := ep.serializer.Serialize(msg)
+	if err != nil {
+		return err
+	}
+	if len(b) > ep.sendLength {
+		return fmt.Errorf("rawsocket: message of %d bytes is longer than the peer accepts", len(b))
+	}
+	return ep.write(rawSocketMessage, b)
+}
+
+// write sends a frame of the given type.
+func (ep *rawSocketPeer) write(frameType byte, payload []byte) error {
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	header[0] = frameType
+	ep.sendMutex.Lock()
+	defer ep.sendMutex.Unlock()
+	_, err := ep.conn.Write(append(header, payload...))
+	return err
+}
+
+func (ep *rawSocketPeer) Receive() <-chan Message {
+	return ep.messages
+}
+
+func (ep *rawSocketPeer) transportDetails() map[string]interface{} {
+	return ep.transport
+}
+
+func (ep *rawSocketPeer) Close() error {
+	ep.sendMutex.Lock()
+	ep.closed = true
+	ep.sendMutex.Unlock()
+	return ep.conn.Close()
+}
+
+func (ep *rawSocketPeer) run() {
+	defer close(ep.messages)
+	header := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(ep.conn, header); err != nil {
+			ep.sendMutex.Lock()
+			closed := ep.closed
+			ep.sendMutex.Unlock()
+			if closed {
+				log.Println("peer connection closed")
+			} else {
+				log.Println("error reading from peer:", err)
+				ep.conn.Close()
+			}
+			return
+		}
+		frameType := header[0]
+		header[0] = 0
+		length := int(binary.BigEndian.Uint32(header))
+		if frameType&0xF8 != 0 || length > ep.receiveLength {
+			log.Printf("invalid frame from peer: type %d, %d bytes", frameType, length)
+			ep.conn.Close()
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(ep.conn, payload); err != nil {
+			log.Println("error reading from peer:", err)
+			ep.conn.Close()
+			return
+		}
+
+		switch frameType {
+		case rawSocketPing:
+			logErr(ep.write(rawSocketPong, payload))
+		case rawSocketPong:
+		case rawSocketMessage:
+			msg, err := ep.serializer.Deserialize(payload)
+			if err != nil {
+				log.Println("error deserializing peer message:", err)
+				// TODO: handle error
+			} else {
+				ep.messages <- msg
+			}
+		default:
+			log.Printf("invalid frame from peer: reserved type %d", frameType)
+			ep.conn.Close()
+			return
+		}
+	}
+}
+
+// RawSocketServer handles WAMP RawSocket connections, over TCP or Unix domain
+// sockets.
+type RawSocketServer struct {
+	Router
+	// MaxMessageLength is the length of the longest message the server
+	// accepts, rounded up to a power of 2 from 512 bytes to 16 MB. Defaults to
+	// 16 MB.
+	MaxMessageLength int
+}
+
+// NewRawSocketServer creates a new RawSocketServer from a map of realms.
+//
+// To serve the same realms as a WebsocketServer, create the RawSocketServer
+// with the WebsocketServer's router instead.
+func NewRawSocketServer(realms map[string]Realm) (*RawSocketServer, error) {
+	r := NewDefaultRouter()
+	for uri, realm := range realms {
+		if err := r.RegisterRealm(URI(uri), realm); err != nil {
+			return nil, err
+		}
+	}
+	return &RawSocketServer{Router: r}, nil
+}
+
+// ListenAndServe listens on the network ("tcp" or "unix") at the address, and
+// serves the connections to it.
+func (s *RawSocketServer) ListenAndServe(network, addr string) error {
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// Serve accepts connections on the listener, until it is closed.
+func (s *RawSocketServer) Serve(l net.Listener) error {
+	defer l.Close()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handleConn(conn)
+	}
+}
+
+func (s *RawSocketServer) handleConn(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(rawSocketTimeout))
+	handshake := make([]byte, 4)
+	if _, err := io.ReadFull(conn, handshake); err != nil {
+		log.Println("error reading rawsocket handshake:", err)
+		conn.Close()
+		return
+	}
+	if handshake[0] != rawSocketMagic {
+		log.Println("invalid rawsocket handshake")
+		conn.Close()
+		return
+	}
+	reject := func(code byte) {
+		log.Println("rejecting rawsocket connection:", rawSocketError(code))
+		conn.Write([]byte{rawSocketMagic, code << 4, 0, 0})
+		conn.Close()
+	}
+	if handshake[2] != 0 || handshake[3] != 0 {
+		reject(rawSocketErrReserved)
+		return
+	}
+	id := handshake[1] & 0x0F
+	serializer := rawSocketSerializer(id)
+	if serializer == nil {
+		reject(rawSocketErrSerializer)
+		return
+	}
+	maxLength := s.MaxMessageLength
+	if maxLength <= 0 {
+		maxLength = rawSocketLength(rawSocketMaxLengthExp)
+	}
+	exp := rawSocketLengthExp(maxLength)
+	if _, err := conn.Write([]byte{rawSocketMagic, exp<<4 | id, 0, 0}); err != nil {
+		log.Println("error writing rawsocket handshake:", err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	peer := newRawSocketPeer(conn, serializer, rawSocketLength(handshake[1]>>4), rawSocketLength(exp))
+	peer.transport = map[string]interface{}{
+		"type": "rawsocket",
+		"peer": conn.RemoteAddr().Network() + ":" + conn.RemoteAddr().String(),
+	}
+	go peer.run()
+
+	logErr(s.Router.Accept(peer))
+}
@@ -0,0 +1,163 @@
+package turnpike
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestRawSocketServer(t *testing.T, network, addr string) (string, io.Closer) {
+	r := NewDefaultRouter()
+	r.RegisterRealm(testRealm, Realm{})
+	s := &RawSocketServer{Router: r}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l.Addr().String(), l
+}
+
+func testRawSocketJoin(t *testing.T, serialization Serialization, network, addr string) {
+	client, err := NewRawSocketClient(serialization, network, addr, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ReceiveTimeout = time.Second
+	if _, err := client.JoinRealm(string(testRealm), nil); err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.Call("wamp.session.count", nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count, _ := toInt64(result.Arguments[0]); count != 1 {
+		t.Errorf("Expected 1 session, got %v", result.Arguments)
+	}
+	client.Close()
+}
+
+func TestRawSocketTCP(t *testing.T) {
+	addr, closer := newTestRawSocketServer(t, "tcp", "127.0.0.1:0")
+	defer closer.Close()
+
+	testRawSocketJoin(t, JSON, "tcp", addr)
+	testRawSocketJoin(t, MSGPACK, "tcp", addr)
+	testRawSocketJoin(t, CBOR, "tcp", addr)
+}
+
+func TestRawSocketUnix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "turnpike")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	addr, closer := newTestRawSocketServer(t, "unix", filepath.Join(dir, "turnpike.sock"))
+	defer closer.Close()
+
+	testRawSocketJoin(t, JSON, "unix", addr)
+}
+
+func TestRawSocketHandshake(t *testing.T) {
+	addr, closer := newTestRawSocketServer(t, "tcp", "127.0.0.1:0")
+	defer closer.Close()
+
+	handshake := func(request []byte) (net.Conn, []byte) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write(request)
+		reply := make([]byte, 4)
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			t.Fatal(err)
+		}
+		return conn, reply
+	}
+
+	conn, reply := handshake([]byte{0x7F, 0x0F, 0, 0})
+	conn.Close()
+	if !bytes.Equal(reply, []byte{0x7F, 0x10, 0, 0}) {
+		t.Errorf("Expected an unsupported serializer error, got % x", reply)
+	}
+
+	conn, reply = handshake([]byte{0x7F, 0x01, 0, 1})
+	conn.Close()
+	if !bytes.Equal(reply, []byte{0x7F, 0x30, 0, 0}) {
+		t.Errorf("Expected a reserved bits error, got % x", reply)
+	}
+
+	conn, reply = handshake([]byte{0x7F, 0x01, 0, 0})
+	defer conn.Close()
+	if !bytes.Equal(reply, []byte{0x7F, 0xF1, 0, 0}) {
+		t.Errorf("Expected JSON with 16 MB messages, got % x", reply)
+	}
+	conn.Write([]byte{rawSocketPing, 0, 0, 4, 'p', 'i', 'n', 'g'})
+	pong := make([]byte, 8)
+	if _, err := io.ReadFull(conn, pong); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pong, []byte{rawSocketPong, 0, 0, 4, 'p', 'i', 'n', 'g'}) {
+		t.Errorf("Expected a PONG with the PING's payload, got % x", pong)
+	}
+	conn.Write([]byte{3, 0, 0, 0})
+	if _, err := conn.Read(pong); err != io.EOF {
+		t.Errorf("Expected the connection to be closed after a reserved frame type, got %v", err)
+	}
+}
+
+func TestRawSocketSerializerMismatch(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handshake := make([]byte, 4)
+		if _, err := io.ReadFull(conn, handshake); err != nil {
+			return
+		}
+		// reply with MessagePack to a JSON request
+		conn.Write([]byte{rawSocketMagic, 0xF0 | rawSocketMsgpack, 0, 0})
+		conn.Read(handshake)
+	}()
+
+	if _, err := NewRawSocketPeer(JSON, "tcp", l.Addr().String(), nil); err == nil {
+		t.Error("Expected a handshake reply with another serializer to be rejected")
+	}
+}
+
+func TestRawSocketMaxMessageLength(t *testing.T) {
+	r := NewDefaultRouter()
+	r.RegisterRealm(testRealm, Realm{})
+	s := &RawSocketServer{Router: r, MaxMessageLength: 1000}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go s.Serve(l)
+
+	client, err := NewRawSocketClient(JSON, "tcp", l.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.ReceiveTimeout = time.Second
+	if _, err := client.JoinRealm(string(testRealm), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Publish("turnpike.test.topic", nil, []interface{}{string(make([]byte, 1024))}, nil); err == nil {
+		t.Error("Expected a message longer than the server accepts not to be sent")
+	}
+}
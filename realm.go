@@ -22,26 +22,68 @@ type Realm struct {
 	Interceptor
 	CRAuthenticators map[string]CRAuthenticator
 	Authenticators   map[string]Authenticator
-	// DefaultAuth      func(details map[string]interface{}) (map[string]interface{}, error)
-	AuthTimeout time.Duration
-	clients     map[ID]*Session
+	// DefaultAuthenticator authenticates clients that offer no authmethods, or
+	// that fail to authenticate with all of the methods they offer. Its
+	// WELCOME details are sent with the "anonymous" authmethod unless they set
+	// another one.
+	DefaultAuthenticator Authenticator
+	AuthTimeout          time.Duration
+	// CallTimeout is the timeout applied to calls that don't specify one. A
+	// timeout set by the callee when registering the procedure still applies
+	// if it is shorter. The default is no timeout.
+	CallTimeout time.Duration
+	// PublisherDisclosure controls whether subscribers are told who published
+	// an event. The default is to disclose publishers that ask for it.
+	PublisherDisclosure DisclosurePolicy
+	// EventHistory configures the topics for which the broker keeps a history
+	// of events, which subscribers can read with wamp.subscription.get_events,
+	// and a retained event. Only the default broker keeps event history.
+	EventHistory map[URI]EventHistory
+	clients      map[ID]*Session
+	// events to publish when a session leaves, see wamp.session.add_testament
+	testaments map[ID][]testament
 	localClient
-	acts chan func()
+	// ID of the realm's own session, used to register the meta API
+	localId ID
+	// procedures the realm's own session calls for its dynamic authenticators
+	// and authorizer
+	localProcedures map[URI]bool
+	acts            chan func()
 }
 
+// DisclosurePolicy is a realm's policy for disclosing publishers to
+// subscribers.
+type DisclosurePolicy int
+
+const (
+	// Disclose publishers that set the "disclose_me" option.
+	DiscloseOnRequest DisclosurePolicy = iota
+	// Disclose all publishers.
+	DiscloseAlways
+	// Never disclose publishers.
+	DiscloseNever
+)
+
 type localClient struct {
 	*Client
 }
 
 func (r *Realm) getPeer(details map[string]interface{}) (Peer, error) {
+	_, peer := r.localSession(details)
+	return peer, nil
+}
+
+// localSession establishes an internal session, and returns it along with the
+// peer that communicates with it.
+func (r *Realm) localSession(details map[string]interface{}) (*Session, Peer) {
 	peerA, peerB := localPipe()
 	if details == nil {
 		details = make(map[string]interface{})
 	}
-	sess := Session{Peer: peerA, Id: NewID(), Details: details, kill: make(chan URI, 1)}
-	go r.handleSession(&sess)
+	sess := newSession(peerA, NewID(), details)
+	go r.handleSession(sess)
 	log.Println("Established internal session:", sess)
-	return peerB, nil
+	return sess, peerB
 }
 
 // Close disconnects all clients after sending a goodbye message
@@ -72,8 +114,10 @@ func (r Realm) Close() {
 
 func (r *Realm) init() {
 	r.clients = make(map[ID]*Session)
+	r.testaments = make(map[ID][]testament)
 	r.acts = make(chan func())
-	p, _ := r.getPeer(nil)
+	sess, p := r.localSession(nil)
+	r.localId = sess.Id
 	r.localClient.Client = NewClient(p)
 	if r.Broker == nil {
 		r.Broker = NewDefaultBroker()
@@ -85,13 +129,39 @@ func (r *Realm) init() {
 		r.Authorizer = NewDefaultAuthorizer()
 	}
 	if r.Interceptor == nil {
-		r.Interceptor = NewDefaultInterceptor()
+		if i, ok := r.Authorizer.(Interceptor); ok {
+			// an authorizer that also intercepts messages, like the role
+			// authorizer, needs to see them to apply its policies
+			r.Interceptor = i
+		} else {
+			r.Interceptor = NewDefaultInterceptor()
+		}
+	}
+	r.localProcedures = make(map[URI]bool)
+	for _, auth := range r.CRAuthenticators {
+		if c, ok := auth.(localCaller); ok {
+			c.setLocalClient(r.localClient.Client)
+			r.localProcedures[c.localProcedure()] = true
+		}
+	}
+	if c, ok := r.Authorizer.(localCaller); ok {
+		c.setLocalClient(r.localClient.Client)
+		r.localProcedures[c.localProcedure()] = true
 	}
 	if r.AuthTimeout == 0 {
 		r.AuthTimeout = defaultAuthTimeout
 	}
+	if br, ok := r.Broker.(*defaultBroker); ok {
+		br.setHistory(r.EventHistory)
+		br.publish = func(msg *Publish) { br.Publish(sess, msg) }
+	}
+	if d, ok := r.Dealer.(*defaultDealer); ok {
+		broker := r.Broker
+		d.publish = func(msg *Publish) { broker.Publish(sess, msg) }
+	}
 	go r.localClient.Receive()
 	go r.run()
+	r.registerMetaAPI()
 }
 
 func (r *Realm) run() {
@@ -125,6 +195,10 @@ func (r *Realm) handleSession(sess *Session) {
 			delete(r.clients, sess.Id)
 			r.Dealer.RemoveSession(sess)
 			r.Broker.RemoveSession(sess)
+			if a, ok := r.Authorizer.(sessionRemover); ok {
+				a.RemoveSession(sess)
+			}
+			r.publishTestaments(sess)
 			r.onLeave(sess.Id)
 		}
 	}()
@@ -148,33 +222,37 @@ func (r *Realm) handleSession(sess *Session) {
 		}
 
 		log.Printf("[%s] %s: %+v", sess, msg.MessageType(), msg)
-		if isAuthz, err := r.Authorizer.Authorize(sess, msg); !isAuthz {
-			errMsg := &Error{Type: msg.MessageType()}
-			switch msg := msg.(type) {
-			case *Publish:
-				errMsg.Request = msg.Request
-			case *Subscribe:
-				errMsg.Request = msg.Request
-			case *Unsubscribe:
-				errMsg.Request = msg.Request
-			case *Register:
-				errMsg.Request = msg.Request
-			case *Unregister:
-				errMsg.Request = msg.Request
-			case *Call:
-				errMsg.Request = msg.Request
-			case *Yield:
-				errMsg.Request = msg.Request
+		if !r.isRealmRequest(sess, msg) {
+			if isAuthz, err := r.Authorizer.Authorize(sess, msg); !isAuthz {
+				errMsg := &Error{Type: msg.MessageType()}
+				switch msg := msg.(type) {
+				case *Publish:
+					errMsg.Request = msg.Request
+				case *Subscribe:
+					errMsg.Request = msg.Request
+				case *Unsubscribe:
+					errMsg.Request = msg.Request
+				case *Register:
+					errMsg.Request = msg.Request
+				case *Unregister:
+					errMsg.Request = msg.Request
+				case *Call:
+					errMsg.Request = msg.Request
+				case *Yield:
+					errMsg.Request = msg.Request
+				case *Cancel:
+					errMsg.Request = msg.Request
+				}
+				if err != nil {
+					errMsg.Error = ErrAuthorizationFailed
+					log.Printf("[%s] authorization failed: %v", sess, err)
+				} else {
+					errMsg.Error = ErrNotAuthorized
+					log.Printf("[%s] %s UNAUTHORIZED", sess, msg.MessageType())
+				}
+				logErr(sess.Send(errMsg))
+				continue
 			}
-			if err != nil {
-				errMsg.Error = ErrAuthorizationFailed
-				log.Printf("[%s] authorization failed: %v", sess, err)
-			} else {
-				errMsg.Error = ErrNotAuthorized
-				log.Printf("[%s] %s UNAUTHORIZED", sess, msg.MessageType())
-			}
-			logErr(sess.Send(errMsg))
-			continue
 		}
 
 		r.Interceptor.Intercept(sess, &msg)
@@ -187,7 +265,12 @@ func (r *Realm) handleSession(sess *Session) {
 
 		// Broker messages
 		case *Publish:
-			r.Broker.Publish(sess, msg)
+			if isMetaURI(msg.Topic) && sess.Id != r.localId {
+				// meta events are only published by the realm
+				logErr(sess.Send(&Error{Type: msg.MessageType(), Request: msg.Request, Details: make(map[string]interface{}), Error: ErrInvalidUri}))
+				continue
+			}
+			r.Broker.Publish(sess, r.preparePublish(msg))
 		case *Subscribe:
 			r.Broker.Subscribe(sess, msg)
 		case *Unsubscribe:
@@ -195,13 +278,26 @@ func (r *Realm) handleSession(sess *Session) {
 
 		// Dealer messages
 		case *Register:
+			match, _ := matchPolicy(msg.Options)
+			if mayMatchMeta(match, msg.Procedure) && sess.Id != r.localId {
+				// the meta API is reserved for the realm
+				logErr(sess.Send(&Error{
+					Type:    msg.MessageType(),
+					Request: msg.Request,
+					Details: make(map[string]interface{}),
+					Error:   ErrInvalidUri,
+				}))
+				continue
+			}
 			r.Dealer.Register(sess, msg)
 		case *Unregister:
 			r.Dealer.Unregister(sess, msg)
 		case *Call:
-			r.Dealer.Call(sess, msg)
+			r.Dealer.Call(sess, r.prepareCall(msg))
 		case *Yield:
 			r.Dealer.Yield(sess, msg)
+		case *Cancel:
+			r.Dealer.Cancel(sess, msg)
 
 		// Error messages
 		case *Error:
@@ -218,6 +314,62 @@ func (r *Realm) handleSession(sess *Session) {
 	}
 }
 
+// isRealmRequest reports whether a message is one the realm's own session
+// sends on the realm's behalf, which is not authorized: registering the meta
+// API, publishing meta events, and calling the procedures of the realm's
+// dynamic authenticators and authorizer.
+func (r *Realm) isRealmRequest(sess *Session, msg Message) bool {
+	if sess.Id != r.localId {
+		return false
+	}
+	switch msg := msg.(type) {
+	case *Register:
+		return isMetaURI(msg.Procedure)
+	case *Publish:
+		return isMetaURI(msg.Topic)
+	case *Call:
+		return r.localProcedures[msg.Procedure]
+	}
+	return false
+}
+
+// preparePublish applies the realm's publisher disclosure policy to the
+// options of a PUBLISH.
+func (r *Realm) preparePublish(msg *Publish) *Publish {
+	if r.PublisherDisclosure == DiscloseOnRequest {
+		return msg
+	}
+	options := make(map[string]interface{})
+	for k, v := range msg.Options {
+		options[k] = v
+	}
+	options["disclose_me"] = r.PublisherDisclosure == DiscloseAlways
+	publish := *msg
+	publish.Options = options
+	return &publish
+}
+
+// prepareCall applies the realm's policies to the options of a CALL.
+//
+// The realm's call timeout is added to a CALL that doesn't specify a timeout,
+// and calls to the meta API always disclose the caller, so that the realm
+// knows which session is calling.
+func (r *Realm) prepareCall(msg *Call) *Call {
+	options := make(map[string]interface{})
+	for k, v := range msg.Options {
+		options[k] = v
+	}
+	if _, ok := options["timeout"]; !ok && r.CallTimeout > 0 {
+		options["timeout"] = int64(r.CallTimeout / time.Millisecond)
+	}
+	if isMetaURI(msg.Procedure) {
+		options["disclose_me"] = true
+	}
+	call := *msg
+	call.Options = options
+	return &call
+}
+
 func (r *Realm) handleAuth(client Peer, details map[string]interface{}) (*Welcome, error) {
 	msg, err := r.authenticate(details)
 	if err != nil {
@@ -247,16 +399,20 @@ func (r *Realm) handleAuth(client Peer, details map[string]interface{}) (*Welcom
 
 // Authenticate either authenticates a client or returns a challenge message if
 // challenge/response authentication is to be used.
+//
+// The authmethods offered by the client are tried in order, until one of them
+// welcomes or challenges the client. If none of them do, the client is
+// authenticated by the realm's default authenticator.
 func (r Realm) authenticate(details map[string]interface{}) (Message, error) {
 	log.Println("details:", details)
-	if len(r.Authenticators) == 0 && len(r.CRAuthenticators) == 0 {
+	if len(r.Authenticators) == 0 && len(r.CRAuthenticators) == 0 && r.DefaultAuthenticator == nil {
 		return &Welcome{}, nil
 	}
 	// TODO: this might not always be a []interface{}. Using the JSON unmarshaller it will be,
 	// but we may have serializations that preserve more of the original type.
 	// For now, the tests just explicitly send a []interface{}
 	_authmethods, ok := details["authmethods"].([]interface{})
-	if !ok {
+	if !ok && r.DefaultAuthenticator == nil {
 		return nil, fmt.Errorf("No authentication supplied")
 	}
 	authmethods := []string{}
@@ -267,24 +423,37 @@ func (r Realm) authenticate(details map[string]interface{}) (Message, error) {
 			log.Printf("invalid authmethod value: %v", method)
 		}
 	}
+	err := fmt.Errorf("could not authenticate with any method")
 	for _, method := range authmethods {
 		if auth, ok := r.CRAuthenticators[method]; ok {
-			if challenge, err := auth.Challenge(details); err != nil {
-				return nil, err
+			if challenge, cerr := auth.Challenge(details); cerr != nil {
+				log.Printf("%s authentication failed: %v", method, cerr)
+				err = cerr
 			} else {
 				return &Challenge{AuthMethod: method, Extra: challenge}, nil
 			}
 		}
 		if auth, ok := r.Authenticators[method]; ok {
-			if authDetails, err := auth.Authenticate(details); err != nil {
-				return nil, err
+			if authDetails, aerr := auth.Authenticate(details); aerr != nil {
+				log.Printf("%s authentication failed: %v", method, aerr)
+				err = aerr
 			} else {
 				return &Welcome{Details: addAuthMethod(authDetails, method)}, nil
 			}
 		}
 	}
-	// TODO: check default auth (special '*' auth?)
-	return nil, fmt.Errorf("could not authenticate with any method")
+	if r.DefaultAuthenticator != nil {
+		authDetails, derr := r.DefaultAuthenticator.Authenticate(details)
+		if derr != nil {
+			return nil, derr
+		}
+		method, _ := authDetails["authmethod"].(string)
+		if method == "" {
+			method = "anonymous"
+		}
+		return &Welcome{Details: addAuthMethod(authDetails, method)}, nil
+	}
+	return nil, err
 }
 
 // checkResponse determines whether the response to the challenge is sufficient to gain access to the Realm.
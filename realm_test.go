@@ -1,8 +1,11 @@
 package turnpike
 
 import (
+	"crypto/ed25519"
+	"encoding/hex"
 	"fmt"
 	"testing"
+	"time"
 
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -137,3 +140,625 @@ func TestCRAuthenticator(t *testing.T) {
 		})
 	})
 }
+
+func TestWampCRAuthentication(t *testing.T) {
+	Convey("Given a realm with WAMP-CRA authentication", t, func() {
+		users := CRAUserMap{
+			"joe":   {AuthRole: "user", Secret: "secret1"},
+			"peter": {AuthRole: "admin", Secret: DeriveCRAKey("secret2", "salt123", 100, 16), Salt: "salt123", Iterations: 100, KeyLen: 16},
+		}
+		realm := Realm{
+			CRAuthenticators: map[string]CRAuthenticator{"wampcra": NewWampCRAuthenticator(users)},
+		}
+		login := func(authid, secret string) (*Welcome, error) {
+			details := map[string]interface{}{
+				"authmethods": []interface{}{"wampcra"},
+				"authid":      authid,
+				"session":     ID(1234),
+			}
+			msg, err := realm.authenticate(details)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			signature, _, err := WampCRAAuthFunc(secret)(details, challenge.Extra)
+			So(err, ShouldBeNil)
+			return realm.checkResponse(challenge, &Authenticate{Signature: signature})
+		}
+
+		Convey("A user with the right secret should be welcomed with their authrole", func() {
+			welcome, err := login("joe", "secret1")
+			So(err, ShouldBeNil)
+			So(welcome.Details["authid"], ShouldEqual, "joe")
+			So(welcome.Details["authrole"], ShouldEqual, "user")
+			So(welcome.Details["authmethod"], ShouldEqual, "wampcra")
+		})
+
+		Convey("A user with a salted secret should be welcomed", func() {
+			welcome, err := login("peter", "secret2")
+			So(err, ShouldBeNil)
+			So(welcome.Details["authrole"], ShouldEqual, "admin")
+		})
+
+		Convey("A user with the wrong secret should be rejected", func() {
+			_, err := login("joe", "secret2")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("An unknown user should not be challenged", func() {
+			_, err := realm.authenticate(map[string]interface{}{
+				"authmethods": []interface{}{"wampcra"},
+				"authid":      "mallory",
+			})
+			So(err, ShouldNotBeNil)
+		})
+	})
+
+	Convey("DeriveCRAKey should implement PBKDF2-HMAC-SHA256", t, func() {
+		So(DeriveCRAKey("password", "salt", 1, 32), ShouldEqual, "Eg+2z/z4syxD5yJSVsT4N6hlSMkszDVICAWYfLcL4Xs=")
+		So(DeriveCRAKey("secret2", "salt123", 100, 48), ShouldEqual, "LG5/FwnS5WvgmlEyLPk/pYn3/wlFRPT4w18Op9fK79WruIu/0+yvDX0a+t6tWLQ8")
+	})
+}
+
+func TestCryptosignAuthentication(t *testing.T) {
+	Convey("Given a realm with cryptosign authentication", t, func() {
+		pub, key, err := ed25519.GenerateKey(nil)
+		So(err, ShouldBeNil)
+		_, otherKey, err := ed25519.GenerateKey(nil)
+		So(err, ShouldBeNil)
+		keys := CryptosignKeyMap{hex.EncodeToString(pub): {AuthId: "device-1", AuthRole: "device"}}
+		realm := Realm{
+			CRAuthenticators: map[string]CRAuthenticator{"cryptosign": NewCryptosignAuthenticator(keys)},
+		}
+		details := map[string]interface{}{
+			"authmethods": []interface{}{"cryptosign"},
+			"authextra":   CryptosignAuthExtra(key),
+		}
+
+		Convey("A client signing with the registered key should be welcomed", func() {
+			msg, err := realm.authenticate(details)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			signature, _, err := CryptosignAuthFunc(key)(details, challenge.Extra)
+			So(err, ShouldBeNil)
+			welcome, err := realm.checkResponse(challenge, &Authenticate{Signature: signature})
+			So(err, ShouldBeNil)
+			So(welcome.Details["authid"], ShouldEqual, "device-1")
+			So(welcome.Details["authrole"], ShouldEqual, "device")
+			So(welcome.Details["authmethod"], ShouldEqual, "cryptosign")
+		})
+
+		Convey("A client signing with another key should be rejected", func() {
+			msg, err := realm.authenticate(details)
+			So(err, ShouldBeNil)
+			challenge := msg.(*Challenge)
+			signature, _, err := CryptosignAuthFunc(otherKey)(details, challenge.Extra)
+			So(err, ShouldBeNil)
+			_, err = realm.checkResponse(challenge, &Authenticate{Signature: signature})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A client with an unregistered key should not be challenged", func() {
+			details["authextra"] = CryptosignAuthExtra(otherKey)
+			_, err := realm.authenticate(details)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestAnonymousAuthentication(t *testing.T) {
+	Convey("Given a realm with ticket and anonymous authentication", t, func() {
+		realm := Realm{
+			CRAuthenticators: map[string]CRAuthenticator{"wampcra": NewWampCRAuthenticator(CRAUserMap{"joe": {AuthRole: "user", Secret: "secret"}})},
+			Authenticators: map[string]Authenticator{
+				"ticket":    &testBasicAuthenticator{},
+				"anonymous": NewAnonymousAuthenticator("guest"),
+			},
+		}
+		authenticate := func(authmethods ...interface{}) (Message, error) {
+			return realm.authenticate(map[string]interface{}{"authmethods": authmethods, "authid": "mallory", "password": "guess"})
+		}
+
+		Convey("Methods should be tried in the client's order", func() {
+			msg, err := authenticate("anonymous", "ticket")
+			So(err, ShouldBeNil)
+			So(msg.(*Welcome).Details["authmethod"], ShouldEqual, "anonymous")
+			So(msg.(*Welcome).Details["authrole"], ShouldEqual, "guest")
+			So(msg.(*Welcome).Details["authid"], ShouldNotBeEmpty)
+		})
+
+		Convey("Methods that fail should fall through to the next one", func() {
+			msg, err := authenticate("wampcra", "ticket", "anonymous")
+			So(err, ShouldBeNil)
+			So(msg.(*Welcome).Details["authmethod"], ShouldEqual, "anonymous")
+		})
+
+		Convey("A client should be rejected when all its methods fail", func() {
+			_, err := authenticate("wampcra", "ticket")
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("A client without authmethods should be rejected", func() {
+			_, err := realm.authenticate(map[string]interface{}{})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("With a default authenticator", func() {
+			realm.DefaultAuthenticator = NewAnonymousAuthenticator("")
+
+			Convey("A client without authmethods should be welcomed anonymously", func() {
+				msg, err := realm.authenticate(map[string]interface{}{})
+				So(err, ShouldBeNil)
+				So(msg.(*Welcome).Details["authmethod"], ShouldEqual, "anonymous")
+				So(msg.(*Welcome).Details["authrole"], ShouldEqual, "anonymous")
+			})
+
+			Convey("A client whose methods fail should be welcomed anonymously", func() {
+				msg, err := authenticate("wampcra", "ticket")
+				So(err, ShouldBeNil)
+				So(msg.(*Welcome).Details["authrole"], ShouldEqual, "anonymous")
+			})
+
+			Convey("A client that can authenticate should still be challenged", func() {
+				msg, err := realm.authenticate(map[string]interface{}{"authmethods": []interface{}{"wampcra"}, "authid": "joe"})
+				So(err, ShouldBeNil)
+				So(msg.(*Challenge).AuthMethod, ShouldEqual, "wampcra")
+			})
+		})
+	})
+}
+
+func TestDynamicAuthentication(t *testing.T) {
+	Convey("Given a realm whose auth service is a WAMP client", t, func() {
+		router := NewDefaultRouter()
+		router.RegisterRealm(testRealm, Realm{
+			CRAuthenticators: map[string]CRAuthenticator{
+				"wampcra": NewWampCRAuthenticator(CRAUserMap{"auth": {AuthRole: "authenticator", Secret: "secret"}}),
+				"ticket":  NewDynamicAuthenticator("com.example.authenticate", time.Second),
+			},
+			Authorizer: NewDynamicAuthorizer(DynamicAuthorizerConfig{
+				Procedure:    "com.example.authorize",
+				Timeout:      time.Second,
+				CacheTTL:     time.Minute,
+				TrustedRoles: []string{"authenticator"},
+			}),
+		})
+		join := func(method string, fn AuthFunc, details map[string]interface{}) (*Client, error) {
+			client := NewClient(router.(*defaultRouter).getTestPeer())
+			client.ReceiveTimeout = 100 * time.Millisecond
+			client.Auth = map[string]AuthFunc{method: fn}
+			_, err := client.JoinRealm(string(testRealm), details)
+			return client, err
+		}
+
+		service, err := join("wampcra", WampCRAAuthFunc("secret"), map[string]interface{}{"authid": "auth"})
+		So(err, ShouldBeNil)
+		err = service.Register("com.example.authenticate", func(args []interface{}, kwargs, details map[string]interface{}) *CallResult {
+			if args[0] == "challenge" {
+				return &CallResult{Args: []interface{}{map[string]interface{}{}}}
+			}
+			if args[2] != "letmein" {
+				return &CallResult{Err: ErrAuthorizationFailed}
+			}
+			return &CallResult{Args: []interface{}{map[string]interface{}{"authid": "alice", "authrole": "user"}}}
+		}, nil)
+		So(err, ShouldBeNil)
+		var authorizations []string
+		err = service.Register("com.example.authorize", func(args []interface{}, kwargs, details map[string]interface{}) *CallResult {
+			session := args[0].(map[string]interface{})
+			authorizations = append(authorizations, fmt.Sprintf("%v %v %v %v", session["authrole"], args[1], args[2], args[3]))
+			return &CallResult{Args: []interface{}{args[1] == "wamp.session.count" || args[3] == "exact" && args[1] == "com.example.news"}}
+		}, nil)
+		So(err, ShouldBeNil)
+		ticket := func(ticket string) AuthFunc {
+			return func(map[string]interface{}, map[string]interface{}) (string, map[string]interface{}, error) {
+				return ticket, nil, nil
+			}
+		}
+
+		Convey("A client with a valid ticket should be authorized by the service", func() {
+			client, err := join("ticket", ticket("letmein"), nil)
+			So(err, ShouldBeNil)
+
+			_, err = client.Call("wamp.session.count", nil, nil, nil)
+			So(err, ShouldBeNil)
+			_, err = client.Call("wamp.session.count", nil, nil, nil)
+			So(err, ShouldBeNil)
+			So(authorizations, ShouldResemble, []string{"user wamp.session.count call exact"})
+
+			err = client.Subscribe("com.example.secret", nil, func([]interface{}, map[string]interface{}) {})
+			So(err, ShouldNotBeNil)
+			So(authorizations, ShouldHaveLength, 2)
+		})
+
+		Convey("The service should be told the match policy of subscriptions", func() {
+			client, err := join("ticket", ticket("letmein"), nil)
+			So(err, ShouldBeNil)
+
+			handler := func([]interface{}, map[string]interface{}) {}
+			So(client.Subscribe("com.example.news", nil, handler), ShouldBeNil)
+			err = client.Subscribe("com.example.news", map[string]interface{}{"match": "prefix"}, handler)
+			So(err, ShouldNotBeNil)
+			So(authorizations, ShouldResemble, []string{
+				"user com.example.news subscribe exact",
+				"user com.example.news subscribe prefix",
+			})
+		})
+
+		Convey("A client with an invalid ticket should be rejected", func() {
+			_, err := join("ticket", ticket("guess"), nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
+
+func TestCallTimeoutDefault(t *testing.T) {
+	Convey("Given a realm with a call timeout", t, func() {
+		realm := Realm{CallTimeout: 2 * time.Second}
+
+		Convey("A call without a timeout should get the realm's timeout", func() {
+			options := map[string]interface{}{"disclose_me": true}
+			call := realm.prepareCall(&Call{Request: 1, Options: options})
+			So(call.Options["timeout"], ShouldEqual, 2000)
+			So(call.Options["disclose_me"], ShouldEqual, true)
+			So(options, ShouldNotContainKey, "timeout")
+		})
+
+		Convey("A call with a timeout should keep it", func() {
+			call := realm.prepareCall(&Call{Request: 1, Options: map[string]interface{}{"timeout": 0}})
+			So(call.Options["timeout"], ShouldEqual, 0)
+		})
+	})
+}
+
+func TestPublisherDisclosurePolicy(t *testing.T) {
+	Convey("Given a publication that asks for disclosure", t, func() {
+		msg := &Publish{Request: 1, Options: map[string]interface{}{"disclose_me": true}}
+
+		Convey("A realm that discloses on request should keep the option", func() {
+			realm := Realm{}
+			So(realm.preparePublish(msg).Options["disclose_me"], ShouldEqual, true)
+		})
+
+		Convey("A realm that never discloses should clear the option", func() {
+			realm := Realm{PublisherDisclosure: DiscloseNever}
+			So(realm.preparePublish(msg).Options["disclose_me"], ShouldEqual, false)
+			So(msg.Options["disclose_me"], ShouldEqual, true)
+		})
+	})
+
+	Convey("A realm that always discloses should set the option", t, func() {
+		realm := Realm{PublisherDisclosure: DiscloseAlways}
+		So(realm.preparePublish(&Publish{Request: 1}).Options["disclose_me"], ShouldEqual, true)
+	})
+}
+
+func TestSessionMetaAPI(t *testing.T) {
+	Convey("Given two clients joined to a realm", t, func() {
+		client1, _ := connectedTestClients()
+
+		Convey("wamp.session.count should count both sessions", func() {
+			result, err := client1.Call("wamp.session.count", nil, nil, nil)
+			So(err, ShouldBeNil)
+			So(result.Arguments, ShouldResemble, []interface{}{2})
+
+			result, err = client1.Call("wamp.session.count", nil, []interface{}{[]string{"admin"}}, nil)
+			So(err, ShouldBeNil)
+			So(result.Arguments, ShouldResemble, []interface{}{0})
+		})
+
+		Convey("wamp.session.list should list both sessions", func() {
+			result, err := client1.Call("wamp.session.list", nil, nil, nil)
+			So(err, ShouldBeNil)
+			ids := result.Arguments[0].([]ID)
+			So(ids, ShouldHaveLength, 2)
+
+			Convey("wamp.session.get should return the details of a session", func() {
+				result, err := client1.Call("wamp.session.get", nil, []interface{}{ids[0]}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments[0].(map[string]interface{})["session"], ShouldEqual, ids[0])
+			})
+		})
+
+		Convey("wamp.session.get should fail for an unknown session", func() {
+			_, err := client1.Call("wamp.session.get", nil, []interface{}{NewID()}, nil)
+			So(err, ShouldHaveSameTypeAs, RPCError{})
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrNoSuchSession)
+		})
+
+		Convey("wamp.session.kill_by_authrole should kill the other session", func() {
+			result, err := client1.Call("wamp.session.kill_by_authrole", nil, []interface{}{""}, nil)
+			So(err, ShouldBeNil)
+			So(result.Arguments, ShouldResemble, []interface{}{1})
+
+			count := 0
+			for i := 0; i < 10; i++ {
+				result, err := client1.Call("wamp.session.count", nil, nil, nil)
+				So(err, ShouldBeNil)
+				if count = result.Arguments[0].(int); count == 1 {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(count, ShouldEqual, 1)
+		})
+
+		Convey("Registering a meta procedure should fail", func() {
+			err := client1.BasicRegister("wamp.session.count", func([]interface{}, map[string]interface{}) *CallResult {
+				return &CallResult{}
+			})
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Publishing a meta event should fail", func() {
+			id := NewID()
+			client1.registerListener(id)
+			So(client1.Send(&Publish{
+				Request: id,
+				Options: map[string]interface{}{"acknowledge": true},
+				Topic:   "wamp.session.on_leave",
+			}), ShouldBeNil)
+			msg, err := client1.waitOnListener(id)
+			So(err, ShouldBeNil)
+			So(msg, ShouldHaveSameTypeAs, &Error{})
+			So(msg.(*Error).Error, ShouldEqual, ErrInvalidUri)
+		})
+
+		Convey("Registering a pattern that may match meta procedures should fail", func() {
+			handler := func([]interface{}, map[string]interface{}, map[string]interface{}) *CallResult {
+				return &CallResult{}
+			}
+			So(client1.Register("wamp", handler, map[string]interface{}{"match": "prefix"}), ShouldNotBeNil)
+			So(client1.Register("", handler, map[string]interface{}{"match": "prefix"}), ShouldNotBeNil)
+			So(client1.Register(".session.", handler, map[string]interface{}{"match": "wildcard"}), ShouldNotBeNil)
+			So(client1.Register("com.acme.", handler, map[string]interface{}{"match": "prefix"}), ShouldBeNil)
+			So(client1.Register("com..get", handler, map[string]interface{}{"match": "wildcard"}), ShouldBeNil)
+		})
+	})
+}
+
+func TestTestaments(t *testing.T) {
+	Convey("Given a client watching for testaments", t, func() {
+		client, watcher := connectedTestClients()
+		offline := make(chan []interface{}, 2)
+		err := watcher.Subscribe("com.acme.presence.offline", nil, func(args []interface{}, kwargs map[string]interface{}) {
+			offline <- args
+		})
+		So(err, ShouldBeNil)
+
+		Convey("A testament should be published when its session leaves", func() {
+			_, err := client.Call("wamp.session.add_testament", nil, []interface{}{"com.acme.presence.offline", []interface{}{"alice"}}, nil)
+			So(err, ShouldBeNil)
+			So(client.LeaveRealm(), ShouldBeNil)
+
+			select {
+			case args := <-offline:
+				So(args, ShouldResemble, []interface{}{"alice"})
+			case <-time.After(100 * time.Millisecond):
+				t.Fatal("testament was not published")
+			}
+		})
+
+		Convey("Flushed testaments should not be published", func() {
+			_, err := client.Call("wamp.session.add_testament", nil, []interface{}{"com.acme.presence.offline", []interface{}{"alice"}}, nil)
+			So(err, ShouldBeNil)
+			result, err := client.Call("wamp.session.flush_testaments", nil, nil, nil)
+			So(err, ShouldBeNil)
+			So(result.Arguments, ShouldResemble, []interface{}{1})
+			So(client.LeaveRealm(), ShouldBeNil)
+
+			select {
+			case <-offline:
+				t.Error("flushed testament was published")
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+
+		Convey("A testament should not choose its subscribers", func() {
+			options := map[string]interface{}{"eligible": []interface{}{}, "disclose_me": true}
+			_, err := client.Call("wamp.session.add_testament", nil, []interface{}{"com.acme.presence.offline", []interface{}{"alice"}},
+				map[string]interface{}{"publish_options": options})
+			So(err, ShouldBeNil)
+			So(client.LeaveRealm(), ShouldBeNil)
+
+			select {
+			case args := <-offline:
+				So(args, ShouldResemble, []interface{}{"alice"})
+			case <-time.After(100 * time.Millisecond):
+				t.Fatal("testament was not published")
+			}
+		})
+
+		Convey("Adding a testament for a meta topic should fail", func() {
+			_, err := client.Call("wamp.session.add_testament", nil, []interface{}{"wamp.session.on_leave", []interface{}{1}}, nil)
+			So(err, ShouldHaveSameTypeAs, RPCError{})
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrInvalidArgument)
+		})
+
+		Convey("Adding a testament with an unknown scope should fail", func() {
+			_, err := client.Call("wamp.session.add_testament", nil, []interface{}{"com.acme.presence.offline"}, map[string]interface{}{"scope": "forever"})
+			So(err, ShouldHaveSameTypeAs, RPCError{})
+			So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrInvalidArgument)
+		})
+	})
+}
+
+func TestSubscriptionMetaAPI(t *testing.T) {
+	Convey("Given a client watching subscription meta events", t, func() {
+		watcher, subscriber := connectedTestClients()
+		created := make(chan []interface{}, 1)
+		deleted := make(chan []interface{}, 1)
+		err := watcher.Subscribe("wamp.subscription.on_create", nil, func(args []interface{}, kwargs map[string]interface{}) {
+			created <- args
+		})
+		So(err, ShouldBeNil)
+		err = watcher.Subscribe("wamp.subscription.on_delete", nil, func(args []interface{}, kwargs map[string]interface{}) {
+			deleted <- args
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Subscribing to a new topic should publish on_create", func() {
+			err := subscriber.Subscribe("telemetry", nil, func([]interface{}, map[string]interface{}) {})
+			So(err, ShouldBeNil)
+
+			var args []interface{}
+			select {
+			case args = <-created:
+			case <-time.After(100 * time.Millisecond):
+				t.Fatal("no on_create event")
+			}
+			So(args, ShouldHaveLength, 2)
+			details := args[1].(map[string]interface{})
+			So(details["uri"], ShouldEqual, "telemetry")
+			So(details["match"], ShouldEqual, MatchExact)
+			id := details["id"].(ID)
+
+			Convey("The subscription meta procedures should describe the subscription", func() {
+				result, err := watcher.Call("wamp.subscription.lookup", nil, []interface{}{"telemetry"}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments, ShouldResemble, []interface{}{id})
+
+				result, err = watcher.Call("wamp.subscription.match", nil, []interface{}{"telemetry"}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments, ShouldResemble, []interface{}{[]ID{id}})
+
+				result, err = watcher.Call("wamp.subscription.get", nil, []interface{}{id}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments[0].(map[string]interface{})["uri"], ShouldEqual, "telemetry")
+
+				result, err = watcher.Call("wamp.subscription.count_subscribers", nil, []interface{}{id}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments, ShouldResemble, []interface{}{1})
+
+				result, err = watcher.Call("wamp.subscription.list_subscribers", nil, []interface{}{id}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments[0], ShouldHaveLength, 1)
+
+				result, err = watcher.Call("wamp.subscription.lookup", nil, []interface{}{"nothing"}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments, ShouldResemble, []interface{}{nil})
+			})
+
+			Convey("Unsubscribing the last subscriber should publish on_delete", func() {
+				So(subscriber.Unsubscribe("telemetry"), ShouldBeNil)
+				select {
+				case args := <-deleted:
+					So(args[1], ShouldEqual, id)
+				case <-time.After(100 * time.Millisecond):
+					t.Fatal("no on_delete event")
+				}
+
+				_, err := watcher.Call("wamp.subscription.get", nil, []interface{}{id}, nil)
+				So(err, ShouldHaveSameTypeAs, RPCError{})
+				So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrNoSuchSubscription)
+			})
+		})
+	})
+}
+
+func TestRegistrationMetaAPI(t *testing.T) {
+	Convey("Given a client watching registration meta events", t, func() {
+		watcher, callee := connectedTestClients()
+		created := make(chan []interface{}, 1)
+		deleted := make(chan []interface{}, 1)
+		err := watcher.Subscribe("wamp.registration.on_create", nil, func(args []interface{}, kwargs map[string]interface{}) {
+			created <- args
+		})
+		So(err, ShouldBeNil)
+		err = watcher.Subscribe("wamp.registration.on_delete", nil, func(args []interface{}, kwargs map[string]interface{}) {
+			deleted <- args
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Registering a new procedure should publish on_create", func() {
+			err := callee.BasicRegister("worker.job", func([]interface{}, map[string]interface{}) *CallResult {
+				return &CallResult{}
+			})
+			So(err, ShouldBeNil)
+
+			var args []interface{}
+			select {
+			case args = <-created:
+			case <-time.After(100 * time.Millisecond):
+				t.Fatal("no on_create event")
+			}
+			So(args, ShouldHaveLength, 2)
+			details := args[1].(map[string]interface{})
+			So(details["uri"], ShouldEqual, "worker.job")
+			So(details["invoke"], ShouldEqual, InvokeSingle)
+			id := details["id"].(ID)
+
+			Convey("The registration meta procedures should describe the registration", func() {
+				result, err := watcher.Call("wamp.registration.lookup", nil, []interface{}{"worker.job"}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments, ShouldResemble, []interface{}{id})
+
+				result, err = watcher.Call("wamp.registration.match", nil, []interface{}{"worker.job"}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments, ShouldResemble, []interface{}{id})
+
+				result, err = watcher.Call("wamp.registration.count_callees", nil, []interface{}{id}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments, ShouldResemble, []interface{}{1})
+
+				result, err = watcher.Call("wamp.registration.list_callees", nil, []interface{}{id}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments[0], ShouldHaveLength, 1)
+
+				result, err = watcher.Call("wamp.registration.match", nil, []interface{}{"worker.other"}, nil)
+				So(err, ShouldBeNil)
+				So(result.Arguments, ShouldResemble, []interface{}{nil})
+			})
+
+			Convey("Unregistering the last callee should publish on_delete", func() {
+				So(callee.Unregister("worker.job"), ShouldBeNil)
+				select {
+				case args := <-deleted:
+					So(args[1], ShouldEqual, id)
+				case <-time.After(100 * time.Millisecond):
+					t.Fatal("no on_delete event")
+				}
+
+				_, err := watcher.Call("wamp.registration.get", nil, []interface{}{id}, nil)
+				So(err, ShouldHaveSameTypeAs, RPCError{})
+				So(err.(RPCError).ErrorMessage.Error, ShouldEqual, ErrNoSuchRegistration)
+			})
+		})
+	})
+}
+
+func TestMayMatchMeta(t *testing.T) {
+	Convey("Patterns that may match a meta URI should be detected", t, func() {
+		So(mayMatchMeta(MatchExact, "wamp.session.count"), ShouldBeTrue)
+		So(mayMatchMeta(MatchExact, "wamp"), ShouldBeFalse)
+		So(mayMatchMeta(MatchPrefix, "wamp.subscription."), ShouldBeTrue)
+		So(mayMatchMeta(MatchPrefix, "wam"), ShouldBeTrue)
+		So(mayMatchMeta(MatchPrefix, ""), ShouldBeTrue)
+		So(mayMatchMeta(MatchPrefix, "wampx"), ShouldBeFalse)
+		So(mayMatchMeta(MatchPrefix, "com.wamp."), ShouldBeFalse)
+		So(mayMatchMeta(MatchWildcard, ".session.count"), ShouldBeTrue)
+		So(mayMatchMeta(MatchWildcard, "wamp..count"), ShouldBeTrue)
+		So(mayMatchMeta(MatchWildcard, "com..count"), ShouldBeFalse)
+		So(mayMatchMeta(MatchWildcard, ""), ShouldBeFalse)
+	})
+}
+
+func TestRealmRequests(t *testing.T) {
+	Convey("Given a realm with a dynamic authenticator", t, func() {
+		realm := &Realm{localId: 1, localProcedures: map[URI]bool{"com.example.authenticate": true}}
+		local, other := &Session{Id: 1}, &Session{Id: 2}
+
+		Convey("Its own session should only be exempt from authorization for the realm's requests", func() {
+			So(realm.isRealmRequest(local, &Register{Procedure: "wamp.session.count"}), ShouldBeTrue)
+			So(realm.isRealmRequest(local, &Publish{Topic: "wamp.session.on_join"}), ShouldBeTrue)
+			So(realm.isRealmRequest(local, &Call{Procedure: "com.example.authenticate"}), ShouldBeTrue)
+			So(realm.isRealmRequest(local, &Publish{Topic: "com.example.topic"}), ShouldBeFalse)
+			So(realm.isRealmRequest(local, &Register{Procedure: "com.example.procedure"}), ShouldBeFalse)
+			So(realm.isRealmRequest(local, &Call{Procedure: "com.example.procedure"}), ShouldBeFalse)
+			So(realm.isRealmRequest(local, &Subscribe{Topic: "com.example.topic"}), ShouldBeFalse)
+		})
+
+		Convey("Other sessions should never be exempt", func() {
+			So(realm.isRealmRequest(other, &Register{Procedure: "wamp.session.count"}), ShouldBeFalse)
+			So(realm.isRealmRequest(other, &Call{Procedure: "com.example.authenticate"}), ShouldBeFalse)
+		})
+	})
+}
@@ -0,0 +1,238 @@
+package turnpike
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// Role is a named set of permissions, assigned to sessions by their authrole.
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// Permission is a rule that allows actions on the URIs that match it.
+//
+// When several rules of a role match a URI, the most specific one applies:
+// an exact rule, then the longest prefix rule, then the most specific
+// wildcard rule.
+//
+// A prefix or wildcard subscription or registration is allowed only if a rule
+// that allows it matches every URI of the pattern, and no more specific rule
+// that may match some of them denies it.
+type Permission struct {
+	URI URI `json:"uri"`
+	// Match is "exact" (the default), "prefix" or "wildcard".
+	Match    string             `json:"match"`
+	Allow    PermissionAllow    `json:"allow"`
+	Disclose PermissionDisclose `json:"disclose"`
+}
+
+// PermissionAllow lists the actions a permission allows.
+type PermissionAllow struct {
+	Call      bool `json:"call"`
+	Register  bool `json:"register"`
+	Publish   bool `json:"publish"`
+	Subscribe bool `json:"subscribe"`
+}
+
+// and returns the actions allowed by both permissions.
+func (a PermissionAllow) and(b PermissionAllow) PermissionAllow {
+	return PermissionAllow{
+		Call:      a.Call && b.Call,
+		Register:  a.Register && b.Register,
+		Publish:   a.Publish && b.Publish,
+		Subscribe: a.Subscribe && b.Subscribe,
+	}
+}
+
+// PermissionDisclose forces the disclosure of callers and publishers to
+// callees and subscribers. When disclosure isn't forced, callers and
+// publishers can still ask to be disclosed.
+type PermissionDisclose struct {
+	Caller    bool `json:"caller"`
+	Publisher bool `json:"publisher"`
+}
+
+// LoadRoles reads a JSON list of roles, as used by NewRoleAuthorizer.
+func LoadRoles(r io.Reader) ([]Role, error) {
+	var roles []Role
+	if err := json.NewDecoder(r).Decode(&roles); err != nil {
+		return nil, fmt.Errorf("error parsing roles: %v", err)
+	}
+	return roles, nil
+}
+
+// RoleAuthorizer is an Authorizer that allows sessions to call, register,
+// publish and subscribe according to the permissions of their authrole.
+//
+// It is also an Interceptor that applies the disclose settings of the
+// permissions. A realm that uses it as its Authorizer also uses it as its
+// Interceptor, unless the realm has another Interceptor.
+type RoleAuthorizer interface {
+	Authorizer
+	Interceptor
+}
+
+// maxCachedPermissions is the number of decisions cached for a session before
+// the cache is cleared, so that sessions can't grow it without bounds.
+const maxCachedPermissions = 1024
+
+type roleAuthorizer struct {
+	roles map[string][]Permission
+	// permissions that applied to each session's URIs and patterns, nil for
+	// no permission
+	cache map[*Session]map[permissionKey]*Permission
+	lock  sync.Mutex
+}
+
+type permissionKey struct {
+	match string
+	uri   URI
+}
+
+// NewRoleAuthorizer creates a RoleAuthorizer with the given roles. Sessions
+// with an authrole that is not one of the roles are not allowed anything.
+func NewRoleAuthorizer(roles []Role) (RoleAuthorizer, error) {
+	a := &roleAuthorizer{
+		roles: make(map[string][]Permission),
+		cache: make(map[*Session]map[permissionKey]*Permission),
+	}
+	for _, role := range roles {
+		for _, p := range role.Permissions {
+			switch matchOrExact(p.Match) {
+			case MatchExact, MatchPrefix, MatchWildcard:
+			default:
+				return nil, fmt.Errorf("invalid match policy %q for %s in role %s", p.Match, p.URI, role.Name)
+			}
+		}
+		a.roles[role.Name] = role.Permissions
+	}
+	return a, nil
+}
+
+// matchOrExact returns the match policy of a permission, which defaults to
+// exact.
+func matchOrExact(match string) string {
+	if match == "" {
+		return MatchExact
+	}
+	return match
+}
+
+func (a *roleAuthorizer) Authorize(session *Session, msg Message) (bool, error) {
+	switch msg := msg.(type) {
+	case *Publish:
+		p := a.permission(session, MatchExact, msg.Topic)
+		return p != nil && p.Allow.Publish, nil
+	case *Subscribe:
+		match, _ := matchPolicy(msg.Options)
+		p := a.permission(session, match, msg.Topic)
+		return p != nil && p.Allow.Subscribe, nil
+	case *Register:
+		match, _ := matchPolicy(msg.Options)
+		p := a.permission(session, match, msg.Procedure)
+		return p != nil && p.Allow.Register, nil
+	case *Call:
+		p := a.permission(session, MatchExact, msg.Procedure)
+		return p != nil && p.Allow.Call, nil
+	}
+	return true, nil
+}
+
+func (a *roleAuthorizer) Intercept(session *Session, msg *Message) {
+	switch m := (*msg).(type) {
+	case *Publish:
+		if p := a.permission(session, MatchExact, m.Topic); p != nil && p.Disclose.Publisher {
+			publish := *m
+			publish.Options = withDiscloseMe(m.Options)
+			*msg = &publish
+		}
+	case *Call:
+		if p := a.permission(session, MatchExact, m.Procedure); p != nil && p.Disclose.Caller {
+			call := *m
+			call.Options = withDiscloseMe(m.Options)
+			*msg = &call
+		}
+	}
+}
+
+// RemoveSession forgets the permissions cached for a session.
+func (a *roleAuthorizer) RemoveSession(session *Session) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	delete(a.cache, session)
+}
+
+// permission returns the permission of the session's role that applies to
+// the URI, or to all the URIs of the pattern for a prefix or wildcard match
+// policy, or nil if there is none.
+func (a *roleAuthorizer) permission(session *Session, match string, uri URI) *Permission {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	key := permissionKey{match, uri}
+	cache, ok := a.cache[session]
+	if !ok || len(cache) >= maxCachedPermissions {
+		cache = make(map[permissionKey]*Permission)
+		a.cache[session] = cache
+	}
+	if p, ok := cache[key]; ok {
+		return p
+	}
+
+	rules := a.roles[session.AuthRole]
+	var best *Permission
+	for i, p := range rules {
+		policy := matchOrExact(p.Match)
+		if !coversPattern(policy, p.URI, match, uri) {
+			continue
+		}
+		if best == nil || morePrecise(policy, p.URI, matchOrExact(best.Match), best.URI) {
+			best = &rules[i]
+		}
+	}
+	if best != nil && match != MatchExact {
+		// more specific rules apply to the URIs of the pattern they match
+		restricted := *best
+		for _, p := range rules {
+			policy := matchOrExact(p.Match)
+			if morePrecise(policy, p.URI, matchOrExact(best.Match), best.URI) && mayOverlap(policy, p.URI, match, uri) {
+				restricted.Allow = restricted.Allow.and(p.Allow)
+			}
+		}
+		best = &restricted
+	}
+	cache[key] = best
+	return best
+}
+
+// morePrecise reports whether a rule with match policy m1 and URI u1 is more
+// specific than one with m2 and u2: exact rules come first, then the longest
+// prefix rules, then the most specific wildcard rules.
+func morePrecise(m1 string, u1 URI, m2 string, u2 URI) bool {
+	rank := map[string]int{MatchExact: 0, MatchPrefix: 1, MatchWildcard: 2}
+	switch {
+	case rank[m1] != rank[m2]:
+		return rank[m1] < rank[m2]
+	case m1 == MatchPrefix:
+		return len(u1) > len(u2)
+	case m1 == MatchWildcard:
+		return moreSpecific(u1, u2)
+	}
+	return false
+}
+
+// withDiscloseMe returns a copy of the options with "disclose_me" set.
+func withDiscloseMe(options map[string]interface{}) map[string]interface{} {
+	disclosed := map[string]interface{}{"disclose_me": true}
+	for k, v := range options {
+		if !strings.EqualFold(k, "disclose_me") {
+			disclosed[k] = v
+		}
+	}
+	return disclosed
+}
@@ -0,0 +1,183 @@
+package turnpike
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+const testRoles = `[
+	{
+		"name": "frontend",
+		"permissions": [
+			{"uri": "com.example.", "match": "prefix", "allow": {"call": true, "subscribe": true}},
+			{"uri": "com.example.admin.", "match": "prefix", "allow": {}},
+			{"uri": "com.example.admin.status", "allow": {"call": true}},
+			{"uri": "org.example..log", "match": "wildcard", "allow": {"publish": true}, "disclose": {"publisher": true}}
+		]
+	},
+	{
+		"name": "backend",
+		"permissions": [
+			{"uri": "com.example.", "match": "prefix", "allow": {"register": true, "publish": true}, "disclose": {"caller": true}}
+		]
+	},
+	{
+		"name": "monitor",
+		"permissions": [
+			{"uri": "com.example.status", "allow": {"register": true, "subscribe": true}}
+		]
+	}
+]`
+
+func TestRoleAuthorizer(t *testing.T) {
+	Convey("Given a role authorizer loaded from JSON", t, func() {
+		roles, err := LoadRoles(strings.NewReader(testRoles))
+		So(err, ShouldBeNil)
+		auth, err := NewRoleAuthorizer(roles)
+		So(err, ShouldBeNil)
+
+		frontend := &Session{Id: 1, AuthRole: "frontend"}
+		backend := &Session{Id: 2, AuthRole: "backend"}
+		authorized := func(sess *Session, msg Message) bool {
+			ok, err := auth.Authorize(sess, msg)
+			So(err, ShouldBeNil)
+			return ok
+		}
+
+		Convey("Sessions should be allowed the actions of their role", func() {
+			So(authorized(frontend, &Call{Procedure: "com.example.add"}), ShouldBeTrue)
+			So(authorized(frontend, &Subscribe{Topic: "com.example.news"}), ShouldBeTrue)
+			So(authorized(frontend, &Register{Procedure: "com.example.add"}), ShouldBeFalse)
+			So(authorized(backend, &Register{Procedure: "com.example.add"}), ShouldBeTrue)
+			So(authorized(backend, &Call{Procedure: "com.example.add"}), ShouldBeFalse)
+		})
+
+		Convey("The most specific rule should apply", func() {
+			So(authorized(frontend, &Call{Procedure: "com.example.admin.reset"}), ShouldBeFalse)
+			So(authorized(frontend, &Call{Procedure: "com.example.admin.status"}), ShouldBeTrue)
+			So(authorized(frontend, &Publish{Topic: "org.example.app.log"}), ShouldBeTrue)
+			So(authorized(frontend, &Publish{Topic: "org.example.app"}), ShouldBeFalse)
+		})
+
+		Convey("Pattern requests should only be allowed if the rules allow all their URIs", func() {
+			monitor := &Session{Id: 3, AuthRole: "monitor"}
+			prefix := map[string]interface{}{"match": "prefix"}
+			wildcard := map[string]interface{}{"match": "wildcard"}
+			So(authorized(monitor, &Subscribe{Topic: "com.example.status"}), ShouldBeTrue)
+			So(authorized(monitor, &Subscribe{Topic: "com.example.status", Options: prefix}), ShouldBeFalse)
+			So(authorized(monitor, &Subscribe{Topic: "com.example.status", Options: wildcard}), ShouldBeFalse)
+			So(authorized(monitor, &Register{Procedure: "com.example.status"}), ShouldBeTrue)
+			So(authorized(monitor, &Register{Procedure: "com.example.status", Options: prefix}), ShouldBeFalse)
+
+			So(authorized(frontend, &Subscribe{Topic: "com.example.news.", Options: prefix}), ShouldBeTrue)
+			So(authorized(frontend, &Subscribe{Topic: "com.example.news..title", Options: wildcard}), ShouldBeTrue)
+			So(authorized(frontend, &Subscribe{Topic: "com..news", Options: wildcard}), ShouldBeFalse)
+			So(authorized(frontend, &Subscribe{Topic: "com.", Options: prefix}), ShouldBeFalse)
+			So(authorized(backend, &Register{Procedure: "com.example.", Options: prefix}), ShouldBeTrue)
+		})
+
+		Convey("Pattern requests should be denied if a more specific rule denies some of their URIs", func() {
+			prefix := map[string]interface{}{"match": "prefix"}
+			wildcard := map[string]interface{}{"match": "wildcard"}
+			So(authorized(frontend, &Subscribe{Topic: "com.example.", Options: prefix}), ShouldBeFalse)
+			So(authorized(frontend, &Subscribe{Topic: "com.example..news", Options: wildcard}), ShouldBeFalse)
+			So(authorized(frontend, &Subscribe{Topic: "com.example.admin.status", Options: prefix}), ShouldBeFalse)
+		})
+
+		Convey("Sessions without a role or URIs without a rule should not be allowed", func() {
+			So(authorized(&Session{Id: 4, AuthRole: "anonymous"}, &Call{Procedure: "com.example.add"}), ShouldBeFalse)
+			So(authorized(frontend, &Call{Procedure: "org.example.add"}), ShouldBeFalse)
+		})
+
+		Convey("Messages that are not about a URI should be allowed", func() {
+			So(authorized(frontend, &Unsubscribe{Subscription: 1}), ShouldBeTrue)
+			So(authorized(frontend, &Goodbye{}), ShouldBeTrue)
+		})
+
+		Convey("Calls and publications should be disclosed as required by the rules", func() {
+			var msg Message = &Call{Procedure: "com.example.add"}
+			auth.Intercept(backend, &msg)
+			So(msg.(*Call).Options["disclose_me"], ShouldEqual, true)
+
+			options := map[string]interface{}{"acknowledge": true}
+			msg = &Publish{Topic: "org.example.app.log", Options: options}
+			auth.Intercept(frontend, &msg)
+			So(msg.(*Publish).Options["disclose_me"], ShouldEqual, true)
+			So(msg.(*Publish).Options["acknowledge"], ShouldEqual, true)
+			So(options, ShouldNotContainKey, "disclose_me")
+
+			msg = &Call{Procedure: "com.example.add"}
+			auth.Intercept(frontend, &msg)
+			So(msg.(*Call).Options, ShouldNotContainKey, "disclose_me")
+		})
+
+		Convey("Decisions should be cached until the session leaves", func() {
+			So(authorized(frontend, &Call{Procedure: "com.example.add"}), ShouldBeTrue)
+			frontend.AuthRole = "backend"
+			So(authorized(frontend, &Call{Procedure: "com.example.add"}), ShouldBeTrue)
+			auth.(sessionRemover).RemoveSession(frontend)
+			So(authorized(frontend, &Call{Procedure: "com.example.add"}), ShouldBeFalse)
+		})
+
+		Convey("The decisions cached for a session should be bounded", func() {
+			for i := 0; i < 2*maxCachedPermissions; i++ {
+				auth.Authorize(frontend, &Call{Procedure: URI(fmt.Sprintf("com.example.proc%d", i))})
+			}
+			So(len(auth.(*roleAuthorizer).cache[frontend]), ShouldBeLessThanOrEqualTo, maxCachedPermissions)
+		})
+	})
+
+	Convey("Rules with an invalid match policy should be rejected", t, func() {
+		_, err := NewRoleAuthorizer([]Role{{Name: "user", Permissions: []Permission{{URI: "com.example.", Match: "regex"}}}})
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Given a client joined to a realm with a role authorizer", t, func() {
+		auth, err := NewRoleAuthorizer([]Role{{Name: "admin", Permissions: []Permission{
+			{URI: "wamp.session.count", Allow: PermissionAllow{Call: true}},
+			{URI: "wamp.session.add_testament", Allow: PermissionAllow{Call: true}},
+			{URI: "com.example.presence", Allow: PermissionAllow{Publish: true}},
+		}}})
+		So(err, ShouldBeNil)
+		router := NewDefaultRouter()
+		router.RegisterRealm(testRealm, Realm{
+			CRAuthenticators: map[string]CRAuthenticator{
+				"wampcra": NewWampCRAuthenticator(CRAUserMap{"joe": {AuthRole: "admin", Secret: "secret"}}),
+			},
+			Authorizer: auth,
+		})
+		client := NewClient(router.(*defaultRouter).getTestPeer())
+		client.ReceiveTimeout = 100 * time.Millisecond
+		client.Auth = map[string]AuthFunc{"wampcra": WampCRAAuthFunc("secret")}
+		_, err = client.JoinRealm(string(testRealm), map[string]interface{}{"authid": "joe"})
+		So(err, ShouldBeNil)
+
+		Convey("The realm should use the authorizer as its interceptor", func() {
+			So(router.(*defaultRouter).realms[testRealm].Interceptor, ShouldEqual, auth)
+		})
+
+		Convey("The realm should still provide the meta API", func() {
+			result, err := client.Call("wamp.session.count", nil, nil, nil)
+			So(err, ShouldBeNil)
+			So(result.Arguments, ShouldResemble, []interface{}{1})
+		})
+
+		Convey("Requests the role doesn't allow should be rejected", func() {
+			_, err := client.Call("wamp.session.list", nil, nil, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, string(ErrNotAuthorized))
+		})
+
+		Convey("Testaments should only be added for topics the role may publish to", func() {
+			_, err := client.Call("wamp.session.add_testament", nil, []interface{}{"com.example.presence"}, nil)
+			So(err, ShouldBeNil)
+			_, err = client.Call("wamp.session.add_testament", nil, []interface{}{"com.example.secret"}, nil)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, string(ErrNotAuthorized))
+		})
+	})
+}
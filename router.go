@@ -7,9 +7,29 @@ import (
 )
 
 var defaultWelcomeDetails = map[string]interface{}{
-	"roles": map[string]struct{}{
-		"broker": {},
-		"dealer": {},
+	"roles": map[string]interface{}{
+		"broker": map[string]interface{}{
+			"features": map[string]interface{}{
+				"pattern_based_subscription":    true,
+				"subscription_meta_api":         true,
+				"subscriber_blackwhite_listing": true,
+				"publisher_identification":      true,
+				"event_history":                 true,
+				"event_retention":               true,
+			},
+		},
+		"dealer": map[string]interface{}{
+			"features": map[string]interface{}{
+				"shared_registration":        true,
+				"pattern_based_registration": true,
+				"call_canceling":             true,
+				"progressive_call_results":   true,
+				"call_timeout":               true,
+				"session_meta_api":           true,
+				"testament_meta_api":         true,
+				"registration_meta_api":      true,
+			},
+		},
 	},
 }
 
@@ -119,6 +139,19 @@ func (r *defaultRouter) Accept(client Peer) error {
 		return NoSuchRealmError(hello.Realm)
 	}
 
+	// the session ID is assigned before authentication, so that authenticators
+	// can include it in their challenge, and they get the realm too
+	id := NewID()
+	if hello.Details == nil {
+		hello.Details = make(map[string]interface{})
+	}
+	hello.Details["session"] = id
+	hello.Details["realm"] = hello.Realm
+	// the transport details come from the router, never from the client
+	delete(hello.Details, "transport")
+	if p, ok := client.(transportPeer); ok && p.transportDetails() != nil {
+		hello.Details["transport"] = p.transportDetails()
+	}
 	welcome, err := realm.handleAuth(client, hello.Details)
 	if err != nil {
 		abort := &Abort{
@@ -130,7 +163,7 @@ func (r *defaultRouter) Accept(client Peer) error {
 		return AuthenticationError(err.Error())
 	}
 
-	welcome.Id = NewID()
+	welcome.Id = id
 
 	if welcome.Details == nil {
 		welcome.Details = make(map[string]interface{})
@@ -141,20 +174,28 @@ func (r *defaultRouter) Accept(client Peer) error {
 			welcome.Details[k] = v
 		}
 	}
+	// the session details are a copy, as the WELCOME details may be read by a
+	// local client once sent
+	details := make(map[string]interface{})
+	for k, v := range welcome.Details {
+		details[k] = v
+	}
+	details["session"] = welcome.Id
+	details["realm"] = hello.Realm
+	sess := newSession(client, welcome.Id, details)
+	// echo the session's identity in the WELCOME details
+	for k, v := range sess.authDetails() {
+		welcome.Details[k] = v
+	}
+	// bind the transport before the client is welcomed, and can reconnect
+	if p, ok := client.(sessionBinder); ok {
+		p.bindSession(sess, hello.Realm)
+	}
 	if err := client.Send(welcome); err != nil {
 		return err
 	}
 	log.Println("Established session:", welcome.Id)
 
-	// session details
-	welcome.Details["session"] = welcome.Id
-	welcome.Details["realm"] = hello.Realm
-	sess := &Session{
-		Peer:    client,
-		Id:      welcome.Id,
-		Details: welcome.Details,
-		kill:    make(chan URI, 1),
-	}
 	for _, callback := range r.sessionOpenCallbacks {
 		go callback(sess, string(hello.Realm))
 	}
@@ -83,6 +83,50 @@ func TestInvalidRealm(t *testing.T) {
 	}
 }
 
+type testIdentityAuthenticator struct{}
+
+func (a *testIdentityAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	return map[string]interface{}{"authid": "alice", "authrole": "admin"}, nil
+}
+
+func TestSessionIdentity(t *testing.T) {
+	r := NewDefaultRouter()
+	defer r.Close()
+	r.RegisterRealm(testRealm, Realm{
+		Authenticators: map[string]Authenticator{"ticket": &testIdentityAuthenticator{}},
+	})
+	sessions := make(chan *Session, 1)
+	r.AddSessionOpenCallback(func(sess *Session, realm string) { sessions <- sess })
+
+	c, server := localPipe()
+	client := &basicPeer{c}
+	client.Send(&Hello{Realm: testRealm, Details: map[string]interface{}{"authmethods": []interface{}{"ticket"}}})
+	if err := r.Accept(server); err != nil {
+		t.Fatal(err)
+	}
+
+	welcome, ok := (<-client.incoming).(*Welcome)
+	if !ok {
+		t.Fatal("Expected first message sent to be a welcome message")
+	}
+	if welcome.Details["authid"] != "alice" || welcome.Details["authrole"] != "admin" || welcome.Details["authmethod"] != "ticket" {
+		t.Errorf("Expected the session's identity in the welcome details, got %v", welcome.Details)
+	}
+
+	sess := <-sessions
+	if sess.AuthId != "alice" || sess.AuthRole != "admin" || sess.AuthMethod != "ticket" {
+		t.Errorf("Expected the session's identity to be set, got %q %q %q", sess.AuthId, sess.AuthRole, sess.AuthMethod)
+	}
+
+	// leave before closing the router, so the session isn't still joining
+	client.outgoing <- &Goodbye{}
+	select {
+	case <-time.After(time.Second):
+		t.Errorf("No goodbye message received after sending goodbye")
+	case <-client.incoming:
+	}
+}
+
 func TestPublishNoAcknowledge(t *testing.T) {
 	c, server := localPipe()
 	client := &basicPeer{c}
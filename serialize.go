@@ -18,6 +18,8 @@ const (
 	JSON Serialization = iota
 	// Use msgpack-encoded strings as a payload.
 	MSGPACK
+	// Use CBOR-encoded strings as a payload.
+	CBOR
 )
 
 // applies a list of values from a WAMP message to a message type
@@ -171,6 +173,47 @@ func (s *MessagePackSerializer) Deserialize(data []byte) (Message, error) {
 	return apply(msgType, arr)
 }
 
+// cborHandle decodes CBOR maps, which have string keys in WAMP, to
+// map[string]interface{}, and integers to int64.
+var cborHandle = &codec.CborHandle{}
+
+func init() {
+	cborHandle.MapType = reflect.TypeOf(map[string]interface{}(nil))
+	cborHandle.SignedInteger = true
+}
+
+// CBORSerializer is an implementation of Serializer that handles serializing
+// and deserializing CBOR encoded payloads.
+//
+// Binary data is sent as CBOR byte strings, and received as []byte.
+type CBORSerializer struct {
+}
+
+// Serialize encodes a Message into a CBOR payload.
+func (s *CBORSerializer) Serialize(msg Message) ([]byte, error) {
+	var b []byte
+	return b, codec.NewEncoderBytes(&b, cborHandle).Encode(toList(msg))
+}
+
+// Deserialize decodes a CBOR payload into a Message.
+func (s *CBORSerializer) Deserialize(data []byte) (Message, error) {
+	var arr []interface{}
+	if err := codec.NewDecoderBytes(data, cborHandle).Decode(&arr); err != nil {
+		return nil, err
+	} else if len(arr) == 0 {
+		return nil, fmt.Errorf("Invalid message")
+	}
+
+	var msgType MessageType
+	if typ, ok := arr[0].(int64); ok {
+		msgType = MessageType(typ)
+	} else {
+		return nil, fmt.Errorf("Unsupported message format")
+	}
+
+	return apply(msgType, arr)
+}
+
 // JSONSerializer is an implementation of Serializer that handles serializing
 // and deserializing JSON encoded payloads.
 type JSONSerializer struct {
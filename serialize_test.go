@@ -63,6 +63,37 @@ func TestApplySlice(t *testing.T) {
 	})
 }
 
+func TestCBORSerializer(t *testing.T) {
+	Convey("Serializing a message with CBOR", t, func() {
+		s := new(CBORSerializer)
+		payload := []byte{0, 1, 2, 0xff}
+		b, err := s.Serialize(&Publish{
+			Request:     123,
+			Options:     map[string]interface{}{"acknowledge": true},
+			Topic:       "some.valid.topic",
+			Arguments:   []interface{}{payload, "hello"},
+			ArgumentsKw: map[string]interface{}{"nested": map[string]interface{}{"count": 1}},
+		})
+		So(err, ShouldBeNil)
+
+		Convey("Should deserialize to the same message", func() {
+			msg, err := s.Deserialize(b)
+			So(err, ShouldBeNil)
+			pubMsg, ok := msg.(*Publish)
+			So(ok, ShouldBeTrue)
+			So(pubMsg.Request, ShouldEqual, 123)
+			So(pubMsg.Topic, ShouldEqual, URI("some.valid.topic"))
+			So(pubMsg.Options["acknowledge"], ShouldEqual, true)
+			So(pubMsg.ArgumentsKw["nested"], ShouldResemble, map[string]interface{}{"count": int64(1)})
+
+			Convey("With binary data as a byte string", func() {
+				So(pubMsg.Arguments[0], ShouldResemble, payload)
+				So(pubMsg.Arguments[1], ShouldEqual, "hello")
+			})
+		})
+	})
+}
+
 func TestBinaryData(t *testing.T) {
 	from := []byte("hello")
 
@@ -10,9 +10,43 @@ type Session struct {
 	Id      ID
 	Details map[string]interface{}
 
+	// identity of the session, as established by the authenticator
+	AuthId       string
+	AuthRole     string
+	AuthMethod   string
+	AuthProvider string
+
 	kill chan URI
 }
 
+// newSession creates a session, and fills in its identity from the "authid",
+// "authrole", "authmethod" and "authprovider" details.
+func newSession(peer Peer, id ID, details map[string]interface{}) *Session {
+	sess := &Session{Peer: peer, Id: id, Details: details, kill: make(chan URI, 1)}
+	sess.AuthId, _ = details["authid"].(string)
+	sess.AuthRole, _ = details["authrole"].(string)
+	sess.AuthMethod, _ = details["authmethod"].(string)
+	sess.AuthProvider, _ = details["authprovider"].(string)
+	return sess
+}
+
+// authDetails returns the identity of the session as a details map, leaving
+// out empty fields.
+func (s *Session) authDetails() map[string]interface{} {
+	details := make(map[string]interface{})
+	for k, v := range map[string]string{
+		"authid":       s.AuthId,
+		"authrole":     s.AuthRole,
+		"authmethod":   s.AuthMethod,
+		"authprovider": s.AuthProvider,
+	} {
+		if v != "" {
+			details[k] = v
+		}
+	}
+	return details
+}
+
 func (s Session) String() string {
 	return fmt.Sprintf("%d", s.Id)
 }
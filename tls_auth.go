@@ -0,0 +1,126 @@
+package turnpike
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+)
+
+// TLSPrincipal is the identity of a client that authenticates with a TLS
+// client certificate.
+type TLSPrincipal struct {
+	// AuthId defaults to the certificate name the principal was found by.
+	AuthId   string
+	AuthRole string
+}
+
+// TLSPrincipalStore looks up the client certificates that can authenticate
+// with the "tls" authmethod.
+type TLSPrincipalStore interface {
+	// GetPrincipal returns the identity registered for a certificate's subject
+	// common name or subject alternative name, or an error if the name is not
+	// registered.
+	GetPrincipal(name string) (*TLSPrincipal, error)
+}
+
+// TLSPrincipalMap is a TLSPrincipalStore that maps certificate names to
+// identities.
+type TLSPrincipalMap map[string]*TLSPrincipal
+
+// GetPrincipal returns the identity registered for the certificate name.
+func (m TLSPrincipalMap) GetPrincipal(name string) (*TLSPrincipal, error) {
+	if principal, ok := m[name]; ok {
+		return principal, nil
+	}
+	return nil, fmt.Errorf("unknown certificate name: %s", name)
+}
+
+type tlsAuthenticator struct {
+	principals TLSPrincipalStore
+}
+
+// NewTLSAuthenticator creates an authenticator, for the "tls" authmethod, that
+// authenticates clients with a verified TLS client certificate.
+//
+// The certificate's subject common name, then its subject alternative names,
+// are looked up in the store, and the first one found identifies the client.
+// The server's tls.Config must verify client certificates, with ClientAuth set
+// to VerifyClientCertIfGiven or RequireAndVerifyClientCert.
+func NewTLSAuthenticator(principals TLSPrincipalStore) Authenticator {
+	return &tlsAuthenticator{principals: principals}
+}
+
+func (a *tlsAuthenticator) Authenticate(details map[string]interface{}) (map[string]interface{}, error) {
+	transport, _ := details["transport"].(map[string]interface{})
+	state, _ := transport["tls"].(map[string]interface{})
+	cert, _ := state["client_cert"].(map[string]interface{})
+	if cert == nil {
+		return nil, fmt.Errorf("no client certificate provided")
+	}
+	if verified, _ := cert["verified"].(bool); !verified {
+		return nil, fmt.Errorf("client certificate is not verified")
+	}
+
+	subject, _ := cert["subject"].(string)
+	sans, _ := cert["sans"].([]string)
+	for _, name := range append([]string{subject}, sans...) {
+		if name == "" {
+			continue
+		}
+		principal, err := a.principals.GetPrincipal(name)
+		if err != nil {
+			continue
+		}
+		authid := principal.AuthId
+		if authid == "" {
+			authid = name
+		}
+		if requested, ok := details["authid"].(string); ok && requested != authid {
+			return nil, fmt.Errorf("client certificate is not registered for %s", requested)
+		}
+		return map[string]interface{}{
+			"authid":       authid,
+			"authrole":     principal.AuthRole,
+			"authprovider": "static",
+		}, nil
+	}
+	return nil, fmt.Errorf("client certificate %s is not registered", cert["subject_dn"])
+}
+
+// tlsDetails returns the transport details of a TLS connection.
+func tlsDetails(state *tls.ConnectionState) map[string]interface{} {
+	details := map[string]interface{}{
+		"version":      tls.VersionName(state.Version),
+		"cipher_suite": tls.CipherSuiteName(state.CipherSuite),
+		"server_name":  state.ServerName,
+	}
+	if len(state.PeerCertificates) > 0 {
+		details["client_cert"] = certDetails(state.PeerCertificates[0], len(state.VerifiedChains) > 0)
+	}
+	return details
+}
+
+// certDetails returns the details of a client certificate.
+func certDetails(cert *x509.Certificate, verified bool) map[string]interface{} {
+	var sans []string
+	sans = append(sans, cert.DNSNames...)
+	sans = append(sans, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		sans = append(sans, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		sans = append(sans, ip.String())
+	}
+	fingerprint := sha256.Sum256(cert.Raw)
+	return map[string]interface{}{
+		"subject":     cert.Subject.CommonName,
+		"subject_dn":  cert.Subject.String(),
+		"issuer_dn":   cert.Issuer.String(),
+		"sans":        sans,
+		"serial":      cert.SerialNumber.String(),
+		"fingerprint": hex.EncodeToString(fingerprint[:]),
+		"verified":    verified,
+	}
+}
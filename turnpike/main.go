@@ -7,20 +7,23 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 
 	"gopkg.in/jcelliott/turnpike.v2"
 )
 
 var (
-	realm string
-	port  int
-	debug bool
+	realm     string
+	port      int
+	rawsocket string
+	debug     bool
 )
 
 func init() {
 	flag.StringVar(&realm, "realm", "realm1", "realm name")
 	flag.IntVar(&port, "port", 8000, "port to run on")
+	flag.StringVar(&rawsocket, "rawsocket", "", "also accept rawsocket connections at network:address, e.g. unix:/run/turnpike.sock or tcp::8001")
 	flag.BoolVar(&debug, "debug", false, "enable debug logging")
 }
 
@@ -40,6 +43,18 @@ func main() {
 		os.Exit(1)
 	}()
 
+	if rawsocket != "" {
+		parts := strings.SplitN(rawsocket, ":", 2)
+		if len(parts) != 2 {
+			log.Fatalf("invalid rawsocket address %q, expected network:address", rawsocket)
+		}
+		rs := &turnpike.RawSocketServer{Router: s.Router}
+		go func() {
+			log.Printf("turnpike rawsocket server starting on %s...", rawsocket)
+			log.Fatal(rs.ListenAndServe(parts[0], parts[1]))
+		}()
+	}
+
 	server := &http.Server{
 		Handler: s,
 		Addr:    fmt.Sprintf(":%d", port),
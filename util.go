@@ -35,6 +35,13 @@ const (
 	// conform - in which case the Router may throw this error.
 	ErrInvalidArgument = URI("wamp.error.invalid_argument")
 
+	// A Dealer or Callee canceled a call previously issued.
+	ErrCanceled = URI("wamp.error.canceled")
+
+	// A Dealer could not complete a call, since the Callee that was handling
+	// it left the realm.
+	ErrCalleeLost = URI("wamp.error.callee_lost")
+
 	// --- Session Close ---
 
 	// The Peer is shutting down completely - used as a GOODBYE (or ABORT) reason.
@@ -80,3 +87,21 @@ func init() {
 func NewID() ID {
 	return ID(rand.Int63n(maxID))
 }
+
+// toInt64 converts a number received in a message to an int64. Numbers have
+// different types depending on the serializer that decoded the message.
+func toInt64(v interface{}) (int64, bool) {
+	switch n := v.(type) {
+	case int:
+		return int64(n), true
+	case int64:
+		return n, true
+	case uint64:
+		return int64(n), true
+	case float64:
+		return int64(n), true
+	case ID:
+		return int64(n), true
+	}
+	return 0, false
+}
@@ -0,0 +1,181 @@
+package turnpike
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"time"
+)
+
+// CRAUser is a user that can authenticate with WAMP-CRA.
+type CRAUser struct {
+	AuthRole string
+	// Secret is the key used to sign challenges. For salted users, this is
+	// the key derived from the user's password with DeriveCRAKey.
+	Secret string
+	// Salt, Iterations and KeyLen are the PBKDF2 parameters that were used to
+	// derive Secret from the user's password. Salt is empty for unsalted
+	// users.
+	Salt       string
+	Iterations int
+	KeyLen     int
+}
+
+// CRAUserStore looks up the users that can authenticate with WAMP-CRA.
+type CRAUserStore interface {
+	// GetUser returns the user with the given authid, or an error if there is
+	// no such user.
+	GetUser(authid string) (*CRAUser, error)
+}
+
+// CRAUserMap is a CRAUserStore that maps authids to users.
+type CRAUserMap map[string]*CRAUser
+
+// GetUser returns the user with the given authid.
+func (m CRAUserMap) GetUser(authid string) (*CRAUser, error) {
+	if user, ok := m[authid]; ok {
+		return user, nil
+	}
+	return nil, fmt.Errorf("no such user: %s", authid)
+}
+
+type wampCRAuthenticator struct {
+	users CRAUserStore
+}
+
+// NewWampCRAuthenticator creates a WAMP-CRA authenticator, for the "wampcra"
+// authmethod, that authenticates the users in the store.
+//
+// Clients provide their authid in the HELLO details, and sign the challenge
+// with their secret, which WampCRAAuthFunc does for turnpike clients.
+func NewWampCRAuthenticator(users CRAUserStore) CRAuthenticator {
+	return &wampCRAuthenticator{users: users}
+}
+
+func (a *wampCRAuthenticator) Challenge(details map[string]interface{}) (map[string]interface{}, error) {
+	authid, _ := details["authid"].(string)
+	if authid == "" {
+		return nil, fmt.Errorf("no authid provided")
+	}
+	user, err := a.users.GetUser(authid)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	challenge, err := json.Marshal(map[string]interface{}{
+		"authid":       authid,
+		"authrole":     user.AuthRole,
+		"authmethod":   "wampcra",
+		"authprovider": "static",
+		"nonce":        base64.StdEncoding.EncodeToString(nonce),
+		"timestamp":    time.Now().UTC().Format(time.RFC3339Nano),
+		"session":      details["session"],
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	extra := map[string]interface{}{"challenge": string(challenge)}
+	if user.Salt != "" {
+		extra["salt"] = user.Salt
+		extra["iterations"] = user.Iterations
+		extra["keylen"] = user.KeyLen
+	}
+	return extra, nil
+}
+
+func (a *wampCRAuthenticator) Authenticate(challenge map[string]interface{}, signature string) (map[string]interface{}, error) {
+	str, _ := challenge["challenge"].(string)
+	var info struct {
+		AuthId string `json:"authid"`
+	}
+	if err := json.Unmarshal([]byte(str), &info); err != nil {
+		return nil, fmt.Errorf("invalid challenge: %v", err)
+	}
+	user, err := a.users.GetUser(info.AuthId)
+	if err != nil {
+		return nil, err
+	}
+	if !hmac.Equal([]byte(signature), []byte(SignCRAChallenge(str, user.Secret))) {
+		return nil, fmt.Errorf("invalid signature")
+	}
+	return map[string]interface{}{
+		"authid":       info.AuthId,
+		"authrole":     user.AuthRole,
+		"authprovider": "static",
+	}, nil
+}
+
+// WampCRAAuthFunc returns an AuthFunc that signs WAMP-CRA challenges with the
+// secret, deriving the key from it first if the router sent a salt.
+//
+// The client must also provide its authid in the HELLO details.
+func WampCRAAuthFunc(secret string) AuthFunc {
+	return func(hello map[string]interface{}, extra map[string]interface{}) (string, map[string]interface{}, error) {
+		challenge, ok := extra["challenge"].(string)
+		if !ok {
+			return "", nil, fmt.Errorf("no challenge data received")
+		}
+		key := secret
+		if salt, ok := extra["salt"].(string); ok {
+			iterations, _ := toInt64(extra["iterations"])
+			keylen, _ := toInt64(extra["keylen"])
+			key = DeriveCRAKey(secret, salt, int(iterations), int(keylen))
+		}
+		return SignCRAChallenge(challenge, key), make(map[string]interface{}), nil
+	}
+}
+
+// SignCRAChallenge signs a WAMP-CRA challenge with the key, and returns the
+// base64-encoded HMAC-SHA256 signature.
+func SignCRAChallenge(challenge, key string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(challenge))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// DeriveCRAKey derives a WAMP-CRA key from a secret with PBKDF2-HMAC-SHA256,
+// and returns it base64-encoded, as Autobahn clients do. Iterations defaults to
+// 1000 and keylen to 32 bytes.
+func DeriveCRAKey(secret, salt string, iterations, keylen int) string {
+	if iterations <= 0 {
+		iterations = 1000
+	}
+	if keylen <= 0 {
+		keylen = 32
+	}
+	key := pbkdf2([]byte(secret), []byte(salt), iterations, keylen, sha256.New)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+// pbkdf2 derives a key from a password as described in RFC 2898.
+func pbkdf2(password, salt []byte, iterations, keylen int, h func() hash.Hash) []byte {
+	prf := hmac.New(h, password)
+	var key []byte
+	for block := uint32(1); len(key) < keylen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.Write(prf, binary.BigEndian, block)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keylen]
+}
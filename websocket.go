@@ -17,6 +17,11 @@ type websocketPeer struct {
 	payloadType int
 	closed      bool
 	sendMutex   sync.Mutex
+	// details of the connection on the router side, see transportDetails
+	transport map[string]interface{}
+	// binds the connection to a new session on the router side, see
+	// bindSession
+	bind func(sess *Session, realm string)
 }
 
 func NewWebsocketPeer(serialization Serialization, url string, requestHeader http.Header, tlscfg *tls.Config, dial DialFunc) (Peer, error) {
@@ -29,6 +34,10 @@ func NewWebsocketPeer(serialization Serialization, url string, requestHeader htt
 		return newWebsocketPeer(url, requestHeader, msgpackWebsocketProtocol,
 			new(MessagePackSerializer), websocket.BinaryMessage, tlscfg, dial,
 		)
+	case CBOR:
+		return newWebsocketPeer(url, requestHeader, cborWebsocketProtocol,
+			new(CBORSerializer), websocket.BinaryMessage, tlscfg, dial,
+		)
 	default:
 		return nil, fmt.Errorf("Unsupported serialization: %v", serialization)
 	}
@@ -69,13 +78,23 @@ func (ep *websocketPeer) Send(msg Message) error {
 func (ep *websocketPeer) Receive() <-chan Message {
 	return ep.messages
 }
+func (ep *websocketPeer) transportDetails() map[string]interface{} {
+	return ep.transport
+}
+func (ep *websocketPeer) bindSession(sess *Session, realm URI) {
+	if ep.bind != nil {
+		ep.bind(sess, string(realm))
+	}
+}
 func (ep *websocketPeer) Close() error {
 	closeMsg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "goodbye")
 	err := ep.conn.WriteControl(websocket.CloseMessage, closeMsg, time.Now().Add(5*time.Second))
 	if err != nil {
 		log.Println("error sending close message:", err)
 	}
+	ep.sendMutex.Lock()
 	ep.closed = true
+	ep.sendMutex.Unlock()
 	return ep.conn.Close()
 }
 
@@ -84,7 +103,10 @@ func (ep *websocketPeer) run() {
 		// TODO: use conn.NextMessage() and stream
 		// TODO: do something different based on binary/text frames
 		if msgType, b, err := ep.conn.ReadMessage(); err != nil {
-			if ep.closed {
+			ep.sendMutex.Lock()
+			closed := ep.closed
+			ep.sendMutex.Unlock()
+			if closed {
 				log.Println("peer connection closed")
 			} else {
 				log.Println("error reading from peer:", err)
@@ -3,6 +3,8 @@ package turnpike
 import (
 	"fmt"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
@@ -10,6 +12,7 @@ import (
 const (
 	jsonWebsocketProtocol    = "wamp.2.json"
 	msgpackWebsocketProtocol = "wamp.2.msgpack"
+	cborWebsocketProtocol    = "wamp.2.cbor"
 )
 
 type invalidPayload byte
@@ -40,6 +43,21 @@ type WebsocketServer struct {
 	TextSerializer Serializer
 	// The serializer to use for binary frames. Defaults to JSONSerializer.
 	BinarySerializer Serializer
+	// TransportHeaders are the HTTP request headers that authenticators get in
+	// the transport details. Defaults to User-Agent, Origin and
+	// X-Forwarded-For.
+	TransportHeaders []string
+
+	// CookieStore enables cookie authentication. Connections are given a
+	// cookie, which is bound to the identity their client authenticates with,
+	// so that later connections with the cookie can be welcomed with the
+	// "cookie" authmethod, see NewCookieAuthenticator.
+	CookieStore CookieStore
+	// CookieName is the name of the cookie, "cbtid" by default.
+	CookieName string
+	// CookieMaxAge is how long cookies authenticate, 0 for as long as the
+	// browser keeps them.
+	CookieMaxAge time.Duration
 }
 
 // NewWebsocketServer creates a new WebsocketServer from a map of realms
@@ -64,12 +82,14 @@ func NewBasicWebsocketServer(uri string) *WebsocketServer {
 
 func newWebsocketServer(r Router) *WebsocketServer {
 	s := &WebsocketServer{
-		Router:    r,
-		protocols: make(map[string]protocol),
+		Router:           r,
+		protocols:        make(map[string]protocol),
+		TransportHeaders: []string{"User-Agent", "Origin", "X-Forwarded-For"},
 	}
 	s.Upgrader = &websocket.Upgrader{}
 	s.RegisterProtocol(jsonWebsocketProtocol, websocket.TextMessage, new(JSONSerializer))
 	s.RegisterProtocol(msgpackWebsocketProtocol, websocket.BinaryMessage, new(MessagePackSerializer))
+	s.RegisterProtocol(cborWebsocketProtocol, websocket.BinaryMessage, new(CBORSerializer))
 	return s
 }
 
@@ -101,17 +121,121 @@ func (s *WebsocketServer) GetLocalClient(realm string, details map[string]interf
 // ServeHTTP handles a new HTTP connection.
 func (s *WebsocketServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	log.Println("WebsocketServer.ServeHTTP", r.Method, r.RequestURI)
+	transport := s.transportDetails(r)
+	var header http.Header
+	if s.CookieStore != nil {
+		cookie, setCookie, err := s.cookie(r)
+		if err != nil {
+			log.Println("Error issuing cookie:", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		transport["cbtid"] = cookie
+		header = setCookie
+	}
 	// TODO: subprotocol?
-	conn, err := s.Upgrader.Upgrade(w, r, nil)
+	conn, err := s.Upgrader.Upgrade(w, r, header)
 	if err != nil {
 		log.Println("Error upgrading to websocket connection:", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	s.handleWebsocket(conn)
+	s.handleWebsocket(conn, transport)
 }
 
-func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn) {
+func (s *WebsocketServer) cookieName() string {
+	if s.CookieName == "" {
+		return "cbtid"
+	}
+	return s.CookieName
+}
+
+// cookie returns the authentication cookie of a request. Requests without a
+// cookie bound to an identity are given a new one, and the header that sets it
+// is returned too. An unbound cookie is never reused, so that a cookie planted
+// in a browser can't be bound to the identity its user authenticates with.
+//
+// The cookie is only sent with same-site requests, so that other sites can't
+// open connections authenticated with it.
+func (s *WebsocketServer) cookie(r *http.Request) (string, http.Header, error) {
+	if c, err := r.Cookie(s.cookieName()); err == nil {
+		if id, err := s.CookieStore.Get(c.Value); err != nil {
+			return "", nil, err
+		} else if id != nil {
+			return c.Value, nil, nil
+		}
+	}
+	value, err := newCookie()
+	if err != nil {
+		return "", nil, err
+	}
+	cookie := &http.Cookie{
+		Name:     s.cookieName(),
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(s.CookieMaxAge / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	}
+	return value, http.Header{"Set-Cookie": {cookie.String()}}, nil
+}
+
+// bindCookie binds the cookie of a new session's connection to the identity
+// the session authenticated with. It is called before the session is
+// welcomed, so that the client can reconnect with the cookie right away.
+func (s *WebsocketServer) bindCookie(sess *Session, realm string) {
+	peer, ok := sess.Peer.(*websocketPeer)
+	if !ok || s.CookieStore == nil {
+		return
+	}
+	cookie, _ := peer.transport["cbtid"].(string)
+	switch sess.AuthMethod {
+	case "", "cookie", "anonymous":
+		return
+	}
+	if cookie == "" {
+		return
+	}
+	id := &CookieIdentity{
+		AuthId:     sess.AuthId,
+		AuthRole:   sess.AuthRole,
+		AuthMethod: sess.AuthMethod,
+		Realm:      realm,
+	}
+	if s.CookieMaxAge > 0 {
+		id.Expires = time.Now().Add(s.CookieMaxAge)
+	}
+	logErr(s.CookieStore.Set(cookie, id))
+}
+
+// transportDetails returns the details of the HTTP request that opened a
+// websocket connection, which authenticators get in the HELLO details as
+// "transport".
+func (s *WebsocketServer) transportDetails(r *http.Request) map[string]interface{} {
+	headers := make(map[string]interface{})
+	for _, h := range s.TransportHeaders {
+		if v := r.Header.Get(h); v != "" {
+			headers[strings.ToLower(h)] = v
+		}
+	}
+	cookies := make(map[string]interface{})
+	for _, c := range r.Cookies() {
+		cookies[c.Name] = c.Value
+	}
+	details := map[string]interface{}{
+		"type":                  "websocket",
+		"peer":                  r.RemoteAddr,
+		"http_headers_received": headers,
+		"cookies":               cookies,
+	}
+	if r.TLS != nil {
+		details["tls"] = tlsDetails(r.TLS)
+	}
+	return details
+}
+
+func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn, transport map[string]interface{}) {
 	var serializer Serializer
 	var payloadType int
 	if proto, ok := s.protocols[conn.Subprotocol()]; ok {
@@ -128,6 +252,9 @@ func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn) {
 		case msgpackWebsocketProtocol:
 			serializer = new(MessagePackSerializer)
 			payloadType = websocket.BinaryMessage
+		case cborWebsocketProtocol:
+			serializer = new(CBORSerializer)
+			payloadType = websocket.BinaryMessage
 		default:
 			conn.Close()
 			return
@@ -139,6 +266,10 @@ func (s *WebsocketServer) handleWebsocket(conn *websocket.Conn) {
 		serializer:  serializer,
 		messages:    make(chan Message, 10),
 		payloadType: payloadType,
+		transport:   transport,
+	}
+	if s.CookieStore != nil {
+		peer.bind = s.bindCookie
 	}
 	go peer.run()
 
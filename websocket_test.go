@@ -1,11 +1,26 @@
 package turnpike
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math/big"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
 func newTestWebsocketServer(t *testing.T) (int, Router, io.Closer) {
@@ -62,3 +77,233 @@ func TestWSHandshakeMsgpack(t *testing.T) {
 		t.Errorf("Message not Welcome message: %T, %+v", msg, msg)
 	}
 }
+
+func TestWSHandshakeCBOR(t *testing.T) {
+	port, r, closer := newTestWebsocketServer(t)
+	defer closer.Close()
+
+	client, err := NewWebsocketPeer(CBOR, fmt.Sprintf("ws://localhost:%d/", port), nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client.Send(&Hello{Realm: testRealm})
+	go r.Accept(client)
+
+	if msg, ok := <-client.Receive(); !ok {
+		t.Fatal("Receive buffer closed")
+	} else if _, ok := msg.(*Welcome); !ok {
+		t.Errorf("Message not Welcome message: %T, %+v", msg, msg)
+	}
+}
+
+// testCertificate creates a certificate for the template, signed by the parent
+// certificate and key, or self-signed if parent is nil.
+func testCertificate(t *testing.T, template, parent *x509.Certificate, parentKey crypto.Signer) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(time.Now().UnixNano())
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestWSTLSAuthentication(t *testing.T) {
+	ca, caKey := testCertificate(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}, nil, nil)
+	clientCert, clientKey := testCertificate(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "billing"},
+		DNSNames:    []string{"billing.internal"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey)
+
+	r := NewDefaultRouter()
+	r.RegisterRealm(testRealm, Realm{
+		Authenticators: map[string]Authenticator{
+			"tls": NewTLSAuthenticator(TLSPrincipalMap{"billing.internal": {AuthRole: "service"}}),
+		},
+	})
+	server := httptest.NewUnstartedServer(newWebsocketServer(r))
+	server.TLS = &tls.Config{ClientAuth: tls.VerifyClientCertIfGiven, ClientCAs: x509.NewCertPool()}
+	server.TLS.ClientCAs.AddCert(ca)
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+	join := func(certs []tls.Certificate, details map[string]interface{}) Message {
+		url := "wss://" + server.Listener.Addr().String() + "/"
+		client, err := NewWebsocketPeer(JSON, url, nil, &tls.Config{RootCAs: roots, Certificates: certs}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		details["authmethods"] = []interface{}{"tls"}
+		client.Send(&Hello{Realm: testRealm, Details: details})
+		msg, err := GetMessageTimeout(client, time.Second)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg
+	}
+
+	certs := []tls.Certificate{{Certificate: [][]byte{clientCert.Raw}, PrivateKey: clientKey}}
+	if welcome, ok := join(certs, map[string]interface{}{}).(*Welcome); !ok {
+		t.Error("Expected a client with a registered certificate to be welcomed")
+	} else if welcome.Details["authid"] != "billing.internal" || welcome.Details["authrole"] != "service" {
+		t.Errorf("Expected the certificate's identity in the welcome details, got %v", welcome.Details)
+	}
+
+	// the transport details can't be forged by the client
+	forged := map[string]interface{}{"transport": map[string]interface{}{"tls": map[string]interface{}{
+		"client_cert": map[string]interface{}{"subject": "billing.internal", "verified": true},
+	}}}
+	if msg := join(nil, forged); msg.MessageType() != ABORT {
+		t.Errorf("Expected a client without a certificate to be aborted, got %s", msg.MessageType())
+	}
+}
+
+func TestWSTransportDetails(t *testing.T) {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:4321"
+	req.Header.Set("User-Agent", "test-client")
+	req.Header.Set("Authorization", "Bearer secret")
+	req.AddCookie(&http.Cookie{Name: "cbtid", Value: "abc"})
+
+	details := newWebsocketServer(NewDefaultRouter()).transportDetails(req)
+	if details["type"] != "websocket" || details["peer"] != "10.0.0.1:4321" {
+		t.Errorf("Expected the transport type and peer address, got %v", details)
+	}
+	headers := details["http_headers_received"].(map[string]interface{})
+	if headers["user-agent"] != "test-client" || headers["authorization"] != nil {
+		t.Errorf("Expected only the selected headers, got %v", headers)
+	}
+	if cookies := details["cookies"].(map[string]interface{}); cookies["cbtid"] != "abc" {
+		t.Errorf("Expected the request's cookies, got %v", cookies)
+	}
+	if _, ok := details["tls"]; ok {
+		t.Error("Expected no TLS details for a plain connection")
+	}
+}
+
+func TestWSCookieAuthentication(t *testing.T) {
+	store := NewMemoryCookieStore()
+	r := NewDefaultRouter()
+	r.RegisterRealm(testRealm, Realm{
+		CRAuthenticators: map[string]CRAuthenticator{
+			"wampcra": NewWampCRAuthenticator(CRAUserMap{"joe": {AuthRole: "user", Secret: "secret"}}),
+		},
+		Authenticators: map[string]Authenticator{"cookie": NewCookieAuthenticator(store)},
+	})
+	s := newWebsocketServer(r)
+	s.CookieStore = store
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	connect := func(cookie string) (*Client, *http.Cookie) {
+		header := http.Header{}
+		if cookie != "" {
+			header.Set("Cookie", "cbtid="+cookie)
+		}
+		dialer := websocket.Dialer{Subprotocols: []string{jsonWebsocketProtocol}}
+		conn, resp, err := dialer.Dial("ws://"+server.Listener.Addr().String()+"/", header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		peer := &websocketPeer{conn: conn, serializer: new(JSONSerializer), messages: make(chan Message, 10), payloadType: websocket.TextMessage}
+		go peer.run()
+		client := NewClient(peer)
+		client.ReceiveTimeout = time.Second
+		for _, c := range resp.Cookies() {
+			if c.Name == "cbtid" {
+				return client, c
+			}
+		}
+		return client, nil
+	}
+
+	client, issued := connect("")
+	if issued == nil {
+		t.Fatal("Expected a cookie to be issued")
+	}
+	if issued.SameSite != http.SameSiteStrictMode || !issued.HttpOnly {
+		t.Errorf("Expected a strict same-site, HTTP-only cookie, got %v", issued)
+	}
+	cookie := issued.Value
+	client.Auth = map[string]AuthFunc{"wampcra": WampCRAAuthFunc("secret")}
+	if _, err := client.JoinRealm(string(testRealm), map[string]interface{}{"authid": "joe"}); err != nil {
+		t.Fatal(err)
+	}
+	// the cookie is bound before the client is welcomed
+	if id, _ := store.Get(cookie); id == nil {
+		t.Fatal("Expected the cookie to be bound once the client is welcomed")
+	}
+
+	client, issued = connect(cookie)
+	if issued != nil {
+		t.Error("Expected no new cookie for an authenticated cookie")
+	}
+	details, err := client.JoinRealm(string(testRealm), map[string]interface{}{"authmethods": []interface{}{"cookie"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if details["authid"] != "joe" || details["authrole"] != "user" || details["authmethod"] != "cookie" {
+		t.Errorf("Expected the cookie's identity in the welcome details, got %v", details)
+	}
+
+	// a cookie chosen by the client is replaced, and doesn't authenticate
+	client, issued = connect("guessed")
+	if issued == nil || issued.Value == "guessed" {
+		t.Errorf("Expected an unknown cookie to be replaced, got %v", issued)
+	}
+	if _, err := client.JoinRealm(string(testRealm), map[string]interface{}{"authmethods": []interface{}{"cookie"}}); err == nil {
+		t.Error("Expected an unknown cookie not to authenticate")
+	}
+}
+
+func TestFileCookieStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "turnpike")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cookies.json")
+
+	store, err := NewFileCookieStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set("current", &CookieIdentity{AuthId: "joe", AuthRole: "user", Realm: "turnpike.test"})
+	store.Set("expired", &CookieIdentity{AuthId: "joe", Expires: time.Now().Add(-time.Minute)})
+	store.Set("deleted", &CookieIdentity{AuthId: "joe"})
+	store.Delete("deleted")
+
+	store, err = NewFileCookieStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := store.Get("current"); id == nil || id.AuthId != "joe" || id.AuthRole != "user" || id.Realm != "turnpike.test" {
+		t.Errorf("Expected the cookie to be kept, got %+v", id)
+	}
+	for _, cookie := range []string{"expired", "deleted"} {
+		if id, _ := store.Get(cookie); id != nil {
+			t.Errorf("Expected the %s cookie not to authenticate", cookie)
+		}
+	}
+}